@@ -0,0 +1,497 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+/*
+   BUILD AND RUN COMMANDS
+   ----------------------
+   `xsharp build file.xs` compiles the program all the way to an executable
+   using the platform's C compiler, and `xsharp run file.xs` builds it into a
+   temporary directory and runs it. The generated C and any object files live
+   in a temporary directory that is removed afterwards unless --keep-temp is
+   given.
+*/
+
+// Toolchain turns generated C into an executable. Builds go through this
+// interface, so the compiler can be swapped, e.g. for one in a container.
+type Toolchain interface {
+	// Name returns the compiler's name, for messages.
+	Name() string
+	// Compile compiles sources, which are in dir, to object files there,
+	// returning their paths.
+	Compile(dir string, sources []string, opts CompileOptions) ([]string, error)
+	// Link links objects, which are in dir, into the executable exe.
+	Link(dir string, objects []string, exe string, opts CompileOptions) error
+}
+
+// CompileOptions are the settings a Toolchain compiles and links with.
+type CompileOptions struct {
+	Std   string // C standard, e.g. "c99".
+	ASan  bool   // Build with AddressSanitizer.
+	UBSan bool   // Build with UndefinedBehaviorSanitizer.
+}
+
+// localToolchain is a C compiler found on this machine.
+type localToolchain struct {
+	name string   // Compiler name, e.g. "gcc" or "cl".
+	path string   // Full path to the compiler executable.
+	args []string // Arguments always passed first, e.g. cc for CC="zig cc".
+}
+
+// Name implements Toolchain.
+func (tc localToolchain) Name() string {
+	return tc.name
+}
+
+// msvc reports whether the toolchain takes cl.exe-style arguments.
+func (tc localToolchain) msvc() bool {
+	return tc.name == "cl"
+}
+
+// Compile implements Toolchain.
+func (tc localToolchain) Compile(dir string, sources []string, opts CompileOptions) ([]string, error) {
+	args, err := tc.compileCommand(sources, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := runCompiler(tc.name, dir, args); err != nil {
+		return nil, err
+	}
+	ext := ".o"
+	if tc.msvc() {
+		ext = ".obj"
+	}
+	var objects []string
+	for _, source := range sources {
+		objects = append(objects, strings.TrimSuffix(source, filepath.Ext(source))+ext)
+	}
+	return objects, nil
+}
+
+// compileCommand returns the command line that compiles sources to object
+// files in the working directory.
+func (tc localToolchain) compileCommand(sources []string, opts CompileOptions) ([]string, error) {
+	flags, err := tc.sanitizerFlags(opts.ASan, opts.UBSan)
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{tc.path}, tc.args...)
+	if tc.msvc() {
+		args = append(args, "/nologo", "/c")
+	} else {
+		args = append(args, "-c")
+	}
+	args = append(append(args, tc.standardFlags(opts.Std)...), flags...)
+	return append(args, sources...), nil
+}
+
+// Link implements Toolchain. The sanitizers need their runtimes linked in,
+// so their flags are given again.
+func (tc localToolchain) Link(dir string, objects []string, exe string, opts CompileOptions) error {
+	flags, err := tc.sanitizerFlags(opts.ASan, opts.UBSan)
+	if err != nil {
+		return err
+	}
+	args := append([]string{tc.path}, tc.args...)
+	if tc.msvc() {
+		args = append(append(args, "/nologo"), flags...)
+		args = append(args, "/Fe"+exe)
+	} else {
+		args = append(append(args, flags...), "-o", exe)
+	}
+	return runCompiler(tc.name, dir, append(args, objects...))
+}
+
+// runCompiler runs the command line args of the named compiler in dir,
+// passing its output on to stderr.
+func runCompiler(name, dir string, args []string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("C compilation with %s failed: %v", name, err)
+	}
+	return nil
+}
+
+// standardFlags returns the flags that select the C standard cstd. cl has
+// no switch for C89 or C99, which it accepts by default.
+func (tc localToolchain) standardFlags(cstd string) []string {
+	if tc.msvc() {
+		if cstd == "c11" {
+			return []string{"/std:c11"}
+		}
+		return nil
+	}
+	return []string{"-std=" + cstd, "-pedantic"}
+}
+
+// sanitizerFlags returns the flags that build with AddressSanitizer and/or
+// UndefinedBehaviorSanitizer, with debug info so reports show source lines.
+func (tc localToolchain) sanitizerFlags(asan, ubsan bool) ([]string, error) {
+	if !asan && !ubsan {
+		return nil, nil
+	}
+	if tc.msvc() {
+		if ubsan {
+			return nil, errors.New("--ubsan is not supported by cl; use clang or gcc")
+		}
+		return []string{"/fsanitize=address", "/Zi"}, nil
+	}
+	var checks []string
+	if asan {
+		checks = append(checks, "address")
+	}
+	if ubsan {
+		checks = append(checks, "undefined")
+	}
+	return []string{"-fsanitize=" + strings.Join(checks, ","), "-g", "-fno-omit-frame-pointer"}, nil
+}
+
+// compileCommand is one entry of a compile_commands.json file, the
+// compilation database read by clangd, clang-tidy and other C tools.
+type compileCommand struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Arguments []string `json:"arguments"`
+}
+
+// writeCompileCommands writes compile_commands.json into dir, describing how
+// each of the generated C files there is compiled with opts; the arguments
+// are the ones the build itself uses. Without a local compiler the entries
+// name plain cc, which the tools still understand.
+func writeCompileCommands(dir string, files []string, opts CompileOptions) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	tc, err := findToolchain()
+	if err != nil {
+		tc = localToolchain{name: "cc", path: "cc"}
+	}
+	entries := []compileCommand{}
+	for _, file := range files {
+		args, err := tc.compileCommand([]string{file}, opts)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, compileCommand{Directory: dir, File: filepath.Join(dir, file), Arguments: args})
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "compile_commands.json"), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error writing compile_commands.json: %v", err)
+	}
+	return nil
+}
+
+// exeSuffix is the file name extension of executables on this platform.
+func exeSuffix() string {
+	if runtime.GOOS == "windows" {
+		return ".exe"
+	}
+	return ""
+}
+
+// findToolchain locates a C compiler. The CC environment variable wins;
+// otherwise the platform's usual compilers are tried in order. Like make, CC
+// may hold a command with arguments, such as "zig cc" or "emcc -O2".
+func findToolchain() (localToolchain, error) {
+	candidates := []string{"cc", "clang", "gcc"}
+	if runtime.GOOS == "windows" {
+		candidates = []string{"cl", "clang", "gcc"}
+	}
+	var args []string
+	if cc := strings.Fields(os.Getenv("CC")); len(cc) > 0 {
+		candidates, args = cc[:1], cc[1:]
+	}
+	for _, name := range candidates {
+		if path, err := exec.LookPath(name); err == nil {
+			base := strings.TrimSuffix(filepath.Base(name), ".exe")
+			return localToolchain{name: base, path: path, args: args}, nil
+		}
+	}
+	return localToolchain{}, fmt.Errorf("no C compiler found (tried %s); set CC to choose one", strings.Join(candidates, ", "))
+}
+
+// buildOptions holds the flags shared by the build and run subcommands.
+type buildOptions struct {
+	keepTemp       bool         // Keep the temporary directory of intermediates.
+	autoSemicolons bool         // See ParseOptions.
+	rewriters      rewriterFlag // Commands run on the tokens; see commandRewriter.
+	output         string       // Path of the executable; build only.
+	container      string       // Image to compile in, instead of a local toolchain; build only.
+	asan           bool         // Build with AddressSanitizer.
+	ubsan          bool         // Build with UndefinedBehaviorSanitizer.
+	cstd           string       // C standard to generate and compile for.
+}
+
+// compileOptions returns the options that concern the C compiler.
+func (opts buildOptions) compileOptions() CompileOptions {
+	return CompileOptions{Std: opts.cstd, ASan: opts.asan, UBSan: opts.ubsan}
+}
+
+// buildFlags declares the flags for a build or run subcommand.
+func buildFlags(name, usage string, opts *buildOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.BoolVar(&opts.keepTemp, "keep-temp", false, "keep the generated C and object files and print where they are")
+	fs.BoolVar(&opts.autoSemicolons, "auto-semicolons", false, "treat line ends as statement terminators where a statement can end")
+	fs.Var(&opts.rewriters, "rewriter", "run `command` on the tokens as JSON before parsing; may be repeated")
+	fs.StringVar(&opts.cstd, "cstd", "c99", "C standard to generate code for and compile with: c89, c99 or c11")
+	fs.BoolVar(&opts.asan, "asan", false, "build with AddressSanitizer to catch memory errors")
+	fs.BoolVar(&opts.ubsan, "ubsan", false, "build with UndefinedBehaviorSanitizer to catch undefined behavior")
+	if name == "build" {
+		fs.StringVar(&opts.output, "o", "", "name of the executable (default: the input file name)")
+		fs.StringVar(&opts.container, "in-container", "", "compile the generated C inside this Docker `image` instead of with a local compiler")
+	}
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// runBuild implements the build subcommand.
+func runBuild(args []string) {
+	var opts buildOptions
+	fs := buildFlags("build", "Usage: compiler build [flags] <input_file>...", &opts)
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	checkStandard(opts.cstd)
+	inputFiles := fs.Args()
+	if opts.output == "" {
+		opts.output = strings.TrimSuffix(filepath.Base(inputFiles[0]), filepath.Ext(inputFiles[0])) + exeSuffix()
+	}
+	tc, err := toolchainFor(opts)
+	if err != nil {
+		fail(err)
+	}
+	startStats("build", inputFiles)
+	if err := buildExecutable(tc, inputFiles, opts.output, opts); err != nil {
+		fail(err)
+	}
+	finishStats(exitOK)
+}
+
+// checkStandard exits with a usage error if cstd is not a known C standard.
+func checkStandard(cstd string) {
+	if !cStandards[cstd] {
+		fmt.Fprintf(os.Stderr, "unknown C standard %q; use c89, c99 or c11\n", cstd)
+		os.Exit(exitUsage)
+	}
+}
+
+// runRun implements the run subcommand. Arguments after the input file are
+// passed to the program, and its exit code becomes ours.
+func runRun(args []string) {
+	var opts buildOptions
+	fs := buildFlags("run", "Usage: compiler run [flags] <input_file> [program args...]", &opts)
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	checkStandard(opts.cstd)
+	inputFile := fs.Arg(0)
+	tc, err := toolchainFor(opts)
+	if err != nil {
+		fail(err)
+	}
+	exeDir, err := ioutil.TempDir("", "xsharp-run-")
+	if err != nil {
+		fail(fmt.Errorf("Error creating temporary directory: %v", err))
+	}
+	exe := filepath.Join(exeDir, strings.TrimSuffix(filepath.Base(inputFile), filepath.Ext(inputFile))+exeSuffix())
+	startStats("run", []string{inputFile})
+	if err := buildExecutable(tc, []string{inputFile}, exe, opts); err != nil {
+		os.RemoveAll(exeDir)
+		fail(err)
+	}
+	finishStats(exitOK) // The program's own running time is not counted.
+	if opts.keepTemp {
+		fmt.Fprintf(os.Stderr, "Keeping executable %s\n", exe)
+	}
+	cmd := exec.Command(exe, fs.Args()[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	if !opts.keepTemp {
+		os.RemoveAll(exeDir)
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		os.Exit(exit.ExitCode())
+	}
+	if err != nil {
+		fail(fmt.Errorf("Error running %s: %v", exe, err))
+	}
+}
+
+// toolchainFor returns the toolchain that builds with opts: a container's
+// if one was chosen, otherwise the local C compiler.
+func toolchainFor(opts buildOptions) (Toolchain, error) {
+	if opts.container != "" {
+		return containerToolchain{image: opts.container}, nil
+	}
+	return findToolchain()
+}
+
+// buildExecutable compiles the X# program made of inputFiles to the
+// executable exe with tc. Every file is compiled even if an earlier one has
+// errors, so that all the problems are reported together.
+func buildExecutable(tc Toolchain, inputFiles []string, exe string, opts buildOptions) error {
+	tempDir, err := ioutil.TempDir("", "xsharp-build-")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary directory: %v", err)
+	}
+	var names []string
+	failed := 0
+	for _, inputFile := range inputFiles {
+		cCode, err := compileFile(inputFile, opts)
+		var internal internalError
+		if errors.As(err, &internal) {
+			os.RemoveAll(tempDir)
+			return err
+		}
+		if err != nil {
+			// Each diagnostic is on its own line; name the file on each.
+			for _, msg := range strings.Split(err.Error(), "\n") {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", inputFile, msg)
+				failed++
+			}
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(inputFile), filepath.Ext(inputFile)) + ".c"
+		for _, taken := range names {
+			if taken == name {
+				// Files from different directories may share a name.
+				name = fmt.Sprintf("%s_%d.c", strings.TrimSuffix(name, ".c"), len(names))
+				break
+			}
+		}
+		names = append(names, name)
+		if err := ioutil.WriteFile(filepath.Join(tempDir, name), []byte(cCode), 0644); err != nil {
+			os.RemoveAll(tempDir)
+			return fmt.Errorf("Error writing output file: %v", err)
+		}
+	}
+	if failed > 0 {
+		os.RemoveAll(tempDir)
+		return fmt.Errorf("%s, 0 warnings across %s", plural(failed, "error"), plural(len(inputFiles), "file"))
+	}
+	if opts.keepTemp {
+		// Make the kept C easy to open in an editor with clangd.
+		if err := writeCompileCommands(tempDir, names, opts.compileOptions()); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Keeping intermediate files in %s\n", tempDir)
+	} else {
+		defer os.RemoveAll(tempDir)
+	}
+	// The compiler may resolve the executable path relative to its own
+	// working directory, so pass it an absolute one.
+	if exe, err = filepath.Abs(exe); err != nil {
+		return err
+	}
+	objects, err := tc.Compile(tempDir, names, opts.compileOptions())
+	if err != nil {
+		return err
+	}
+	return tc.Link(tempDir, objects, exe, opts.compileOptions())
+}
+
+// compileFile translates the X# file inputFile to C.
+func compileFile(inputFile string, opts buildOptions) (string, error) {
+	data, err := ioutil.ReadFile(inputFile)
+	if err != nil {
+		return "", fmt.Errorf("Error reading input file: %v", err)
+	}
+	ast, err := parseSource(string(data), inputFile, ParseOptions{AutoSemicolons: opts.autoSemicolons, Rewriters: opts.rewriters.rewriters()})
+	if err != nil {
+		return "", err
+	}
+	gen := NewCodeGenerator(ast)
+	gen.std = opts.cstd
+	return generateC(gen)
+}
+
+// plural returns n followed by noun, made plural unless n is 1.
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// containerToolchain compiles with the cc of a Docker image. The build
+// directory, and for linking the executable's directory, are mounted into
+// the container, so the image only needs a C compiler.
+type containerToolchain struct {
+	image string // Docker image to run cc in.
+}
+
+// Name implements Toolchain.
+func (tc containerToolchain) Name() string {
+	return "cc in " + tc.image
+}
+
+// Compile implements Toolchain.
+func (tc containerToolchain) Compile(dir string, sources []string, opts CompileOptions) ([]string, error) {
+	cc := localToolchain{name: "cc", path: "cc"}
+	args, err := cc.compileCommand(sources, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := tc.run(dir, "", args); err != nil {
+		return nil, err
+	}
+	var objects []string
+	for _, source := range sources {
+		objects = append(objects, strings.TrimSuffix(source, filepath.Ext(source))+".o")
+	}
+	return objects, nil
+}
+
+// Link implements Toolchain.
+func (tc containerToolchain) Link(dir string, objects []string, exe string, opts CompileOptions) error {
+	cc := localToolchain{name: "cc", path: "cc"}
+	flags, err := cc.sanitizerFlags(opts.ASan, opts.UBSan)
+	if err != nil {
+		return err
+	}
+	args := append(append([]string{"cc"}, flags...), "-o", "/out/"+filepath.Base(exe))
+	return tc.run(dir, filepath.Dir(exe), append(args, objects...))
+}
+
+// run runs the command line args in the container, with dir mounted as its
+// working directory and, if given, out mounted as /out.
+func (tc containerToolchain) run(dir, out string, args []string) error {
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return fmt.Errorf("--in-container needs docker on the PATH: %v", err)
+	}
+	run := []string{docker, "run", "--rm", "-v", dir + ":/src", "-w", "/src"}
+	if out != "" {
+		run = append(run, "-v", out+":/out")
+	}
+	if runtime.GOOS != "windows" {
+		// Run as the calling user so the files are not owned by root.
+		run = append(run, "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()))
+	}
+	return runCompiler(tc.Name(), dir, append(append(run, tc.image), args...))
+}
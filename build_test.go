@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeToolchain records the steps of a build instead of running a compiler.
+type fakeToolchain struct {
+	compiled []string       // Sources passed to Compile.
+	sources  []string       // Their contents, read when Compile ran.
+	linked   []string       // Objects passed to Link.
+	exe      string         // Executable passed to Link.
+	opts     CompileOptions // Options passed to Compile.
+	fail     error          // Error for Compile to return.
+}
+
+func (tc *fakeToolchain) Name() string {
+	return "fake"
+}
+
+func (tc *fakeToolchain) Compile(dir string, sources []string, opts CompileOptions) ([]string, error) {
+	tc.compiled, tc.opts = sources, opts
+	var objects []string
+	for _, source := range sources {
+		data, err := ioutil.ReadFile(filepath.Join(dir, source))
+		if err != nil {
+			return nil, err
+		}
+		tc.sources = append(tc.sources, string(data))
+		objects = append(objects, strings.TrimSuffix(source, ".c")+".o")
+	}
+	return objects, tc.fail
+}
+
+func (tc *fakeToolchain) Link(dir string, objects []string, exe string, opts CompileOptions) error {
+	tc.linked, tc.exe = objects, exe
+	return nil
+}
+
+// writeSources writes X# files into a temporary directory, returning their
+// paths in the order given.
+func writeSources(t *testing.T, files ...string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var paths []string
+	for i := 0; i < len(files); i += 2 {
+		path := filepath.Join(dir, files[i])
+		if err := ioutil.WriteFile(path, []byte(files[i+1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestBuildExecutableCompilesThenLinks(t *testing.T) {
+	inputs := writeSources(t,
+		"main.xs", "int main() {\n    return helper();\n}\n",
+		"helper.xs", "int helper() {\n    return 7;\n}\n",
+	)
+	tc := &fakeToolchain{}
+	exe := filepath.Join(t.TempDir(), "prog")
+	opts := buildOptions{cstd: "c11", asan: true}
+	if err := buildExecutable(tc, inputs, exe, opts); err != nil {
+		t.Fatalf("buildExecutable: %v", err)
+	}
+	if want := []string{"main.c", "helper.c"}; !reflect.DeepEqual(tc.compiled, want) {
+		t.Errorf("compiled %v, want %v", tc.compiled, want)
+	}
+	if want := (CompileOptions{Std: "c11", ASan: true}); tc.opts != want {
+		t.Errorf("compiled with %+v, want %+v", tc.opts, want)
+	}
+	if len(tc.sources) != 2 || !strings.Contains(tc.sources[1], "int helper() {") {
+		t.Errorf("generated C not written before compiling: %q", tc.sources)
+	}
+	if want := []string{"main.o", "helper.o"}; !reflect.DeepEqual(tc.linked, want) {
+		t.Errorf("linked %v, want %v", tc.linked, want)
+	}
+	if tc.exe != exe {
+		t.Errorf("linked into %s, want %s", tc.exe, exe)
+	}
+}
+
+func TestBuildExecutableRenamesClashingSources(t *testing.T) {
+	first := writeSources(t, "main.xs", "int main() {\n    return 0;\n}\n")
+	second := writeSources(t, "main.xs", "int other() {\n    return 1;\n}\n")
+	tc := &fakeToolchain{}
+	if err := buildExecutable(tc, append(first, second...), filepath.Join(t.TempDir(), "prog"), buildOptions{cstd: "c99"}); err != nil {
+		t.Fatalf("buildExecutable: %v", err)
+	}
+	if want := []string{"main.c", "main_1.c"}; !reflect.DeepEqual(tc.compiled, want) {
+		t.Errorf("compiled %v, want %v", tc.compiled, want)
+	}
+}
+
+func TestBuildExecutableSummarizesErrors(t *testing.T) {
+	inputs := writeSources(t,
+		"bad1.xs", "int main() {\n    return 0 @ $;\n}\n",
+		"bad2.xs", "int main() {\n    return 0\n}\n",
+		"good.xs", "int f() {\n    return 0;\n}\n",
+	)
+	tc := &fakeToolchain{}
+	// Keep the per-file diagnostics out of the test output.
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	stderr := os.Stderr
+	os.Stderr = null
+	err = buildExecutable(tc, inputs, filepath.Join(t.TempDir(), "prog"), buildOptions{cstd: "c99"})
+	os.Stderr = stderr
+	if err == nil || err.Error() != "3 errors, 0 warnings across 3 files" {
+		t.Errorf("got error %v, want the summary of 3 errors across 3 files", err)
+	}
+	if tc.compiled != nil || tc.linked != nil {
+		t.Errorf("toolchain ran despite errors: compiled %v, linked %v", tc.compiled, tc.linked)
+	}
+}
+
+func TestBuildExecutableStopsWhenCompileFails(t *testing.T) {
+	inputs := writeSources(t, "main.xs", "int main() {\n    return 0;\n}\n")
+	tc := &fakeToolchain{fail: errors.New("C compilation with fake failed")}
+	err := buildExecutable(tc, inputs, filepath.Join(t.TempDir(), "prog"), buildOptions{cstd: "c99"})
+	if err != tc.fail {
+		t.Errorf("got error %v, want %v", err, tc.fail)
+	}
+	if tc.linked != nil {
+		t.Errorf("linked %v after a failed compile", tc.linked)
+	}
+}
+
+func TestCompileCommandMatchesBuild(t *testing.T) {
+	tc := localToolchain{name: "gcc", path: "/usr/bin/gcc"}
+	args, err := tc.compileCommand([]string{"a.c"}, CompileOptions{Std: "c89", UBSan: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/usr/bin/gcc", "-c", "-std=c89", "-pedantic", "-fsanitize=undefined", "-g", "-fno-omit-frame-pointer", "a.c"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("got %q, want %q", args, want)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/*
+   EXPLAIN COMMAND
+   ---------------
+   `xsharp explain file.xs` prints the source next to the C code it compiles to,
+   so it is easy to see what each construct lowers to. Each source line is
+   printed beside the first C line generated from it, using the spans the
+   code generator records.
+*/
+
+// explainWidth caps the width of the source pane; longer lines are cut short.
+const explainWidth = 48
+
+// runExplain implements the explain subcommand.
+func runExplain(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: compiler explain <input_file>")
+		os.Exit(exitUsage)
+	}
+	inputFile := args[0]
+	data, err := ioutil.ReadFile(inputFile)
+	if err != nil {
+		fail(fmt.Errorf("Error reading input file: %v", err))
+	}
+	source := string(data)
+	ast, err := parseSource(source, inputFile, ParseOptions{})
+	if err != nil {
+		fail(err)
+	}
+	gen := NewCodeGenerator(ast)
+	cCode, err := generateC(gen)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Print(sideBySide(inputFile, source, "generated C", cCode, gen.spans))
+}
+
+// lineOwners returns, for each of n generated lines, the source line of the
+// innermost span containing it, or 0 if there is none.
+func lineOwners(n int, spans []SourceSpan) []int {
+	owners := make([]int, n)
+	size := make([]int, n)
+	for _, span := range spans {
+		for i := span.First; i <= span.Last && i < n; i++ {
+			if owners[i] == 0 || span.Last-span.First < size[i] {
+				owners[i], size[i] = span.Line, span.Last-span.First
+			}
+		}
+	}
+	return owners
+}
+
+// sideBySide lays out the numbered source lines in a left pane and the
+// generated C in a right pane. A source line goes beside the first line
+// generated from it, per spans; the lines before it in the source, such as
+// comments, go on rows of their own above.
+func sideBySide(leftTitle, left, rightTitle, right string, spans []SourceSpan) string {
+	leftLines := strings.Split(strings.TrimRight(left, "\n"), "\n")
+	rightLines := strings.Split(strings.TrimRight(right, "\n"), "\n")
+
+	// Number the source lines and work out the pane width.
+	width := len(leftTitle)
+	for i, line := range leftLines {
+		line = fmt.Sprintf("%3d  %s", i+1, strings.ReplaceAll(line, "\t", "    "))
+		if len(line) > explainWidth {
+			line = line[:explainWidth-1] + ">"
+		}
+		leftLines[i] = line
+		if len(line) > width {
+			width = len(line)
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "%-*s | %s\n", width, leftTitle, rightTitle)
+	fmt.Fprintf(&out, "%s-+-%s\n", strings.Repeat("-", width), strings.Repeat("-", len(rightTitle)))
+	row := func(l, r string) {
+		out.WriteString(strings.TrimRight(fmt.Sprintf("%-*s | %s", width, l, r), " ") + "\n")
+	}
+	next := 1 // The next source line to print.
+	for i, owner := range lineOwners(len(rightLines), spans) {
+		if owner < next || owner > len(leftLines) {
+			// Nothing new: more C for a line already shown, or none.
+			row("", rightLines[i])
+			continue
+		}
+		for ; next < owner; next++ {
+			row(leftLines[next-1], "")
+		}
+		row(leftLines[owner-1], rightLines[i])
+		next = owner + 1
+	}
+	for ; next <= len(leftLines); next++ {
+		row(leftLines[next-1], "")
+	}
+	return out.String()
+}
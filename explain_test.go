@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestExplainPairsBySpan(t *testing.T) {
+	source := "// Doubles n.\nint twice(int n) {\n    int r = n * 2;\n    return r;\n}\n"
+	ast, err := parseSource(source, "a.xs", ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := NewCodeGenerator(ast)
+	code, err := generateC(gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `a.xs                    | C
+------------------------+--
+                        | #include <stdio.h>
+                        | #include <stdlib.h>
+                        | #include <string.h>
+                        | #include <stdbool.h>
+                        |
+                        | #ifndef XS_STRING
+                        | #define XS_STRING
+                        | typedef char* string;
+                        | #endif
+                        |
+  1  // Doubles n.      |
+  2  int twice(int n) { | int twice(int n) {
+  3      int r = n * 2; |     int r = n * 2;
+  4      return r;      |     return r;
+                        | }
+  5  }                  |
+`
+	if got := sideBySide("a.xs", source, "C", code, gen.spans); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
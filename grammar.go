@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+   GRAMMAR
+   -------
+   The syntax the parser accepts, written down as data so that
+   `xsharp grammar` can print it. The rules mirror the parse* functions and
+   must be updated along with them. Token names in capitals are the token
+   types of tokenSpecs, which are printed with their regexes.
+*/
+
+// grammarRule is one production of the grammar, in EBNF.
+type grammarRule struct {
+	Name string // The nonterminal defined.
+	Body string // Its definition.
+}
+
+// grammar lists the productions, starting from the whole program.
+var grammar = []grammarRule{
+	{"program", `{ topLevel } EOF`},
+	{"topLevel", `[ "[" "immutable" "]" ] [ "public" | "private" ] ( class | function | varDecl )`},
+	{"class", `"class" ID [ ":" ID ] "{" { member } "}"`},
+	{"member", `function | "readonly" varDecl | statement`},
+	{"function", `type ID "(" [ param { "," param } [ "," ] ] ")" block`},
+	{"param", `type ID`},
+	{"type", `ID { "*" }`},
+	{"block", `"{" { statement } "}"`},
+	{"statement", `ifStmt | whileStmt | switchStmt | returnStmt | deleteStmt | block | varDecl | assignment | expression ";"`},
+	{"varDecl", `type ID [ "=" expression ] ";"`},
+	{"assignment", `expression ( "=" | ASSIGN_OP ) expression ";"`},
+	{"ifStmt", `"if" "(" expression ")" block [ "else" ( ifStmt | block ) ]`},
+	{"whileStmt", `"while" "(" expression ")" block`},
+	{"switchStmt", `"switch" "(" expression ")" "{" { caseClause } "}"`},
+	{"caseClause", `( "case" expression | "default" ) ":" { statement } [ "fallthrough" ";" ]`},
+	{"returnStmt", `"return" [ expression ] ";"`},
+	{"deleteStmt", `"delete" expression ";"`},
+	{"expression", `logicalOr`},
+	{"logicalOr", `logicalAnd { "||" logicalAnd }`},
+	{"logicalAnd", `bitOr { "&&" bitOr }`},
+	{"bitOr", `bitXor { "|" bitXor }`},
+	{"bitXor", `bitAnd { "^" bitAnd }`},
+	{"bitAnd", `equality { "&" equality }`},
+	{"equality", `relational { ( "==" | "!=" ) relational }`},
+	{"relational", `shift { ( "<" | ">" | "<=" | ">=" ) shift }`},
+	{"shift", `additive { ( "<<" | ">>" ) additive }`},
+	{"additive", `multiplicative { ( "+" | "-" ) multiplicative }`},
+	{"multiplicative", `unary { ( "*" | "/" | "%" ) unary }`},
+	{"unary", `( "!" | "~" | "-" | "+" | "++" | "--" ) unary | postfix`},
+	{"postfix", `primary { "." ID | "[" expression "]" | "(" [ expression { "," expression } [ "," ] ] ")" | "++" | "--" }`},
+	{"primary", `NUMBER | STRING | RAW_STRING | PATH_STRING | CHAR | INTERP_STRING | ID { "::" ID } | "nameof" "(" ID { "." ID } ")" | "(" expression ")" | objectLiteral | newExpr`},
+	{"newExpr", `"new" ID "(" ")"`},
+	{"objectLiteral", `"{" [ ID ":" expression { "," ID ":" expression } [ "," ] ] "}"`},
+}
+
+// runGrammar implements the grammar subcommand.
+func runGrammar(args []string) {
+	fs := flag.NewFlagSet("grammar", flag.ExitOnError)
+	format := fs.String("format", "ebnf", "output `format`; only ebnf is supported")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: compiler grammar [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if *format != "ebnf" {
+		fmt.Fprintf(os.Stderr, "unknown grammar format %q; only ebnf is supported\n", *format)
+		os.Exit(exitUsage)
+	}
+	writeEBNF(os.Stdout)
+}
+
+// writeEBNF writes the grammar in ISO EBNF, followed by the tokens, whose
+// regexes are given as special sequences.
+func writeEBNF(w io.Writer) {
+	width := 0
+	for _, rule := range grammar {
+		width = max(width, len(rule.Name))
+	}
+	fmt.Fprintf(w, "(* xsharp %s *)\n\n", versionString())
+	for _, rule := range grammar {
+		fmt.Fprintf(w, "%-*s = %s ;\n", width, rule.Name, rule.Body)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "(* Tokens, as Go regular expressions. Keywords are reserved IDs;")
+	fmt.Fprintln(w, "   comments and whitespace between tokens are skipped. *)")
+	for _, spec := range tokenSpecs {
+		switch spec.Type {
+		case "OPEN_STRING", "OPEN_RAW_STRING", "COMMENT", "BLOCK_COMMENT", "NEWLINE", "SKIP", "MISMATCH":
+			// Errors and trivia, not tokens the parser sees.
+			continue
+		}
+		// A ? would end the special sequence, so write the ? quantifier in
+		// its longer, equivalent form.
+		fmt.Fprintf(w, "%-*s = ? /%s/ ? ;\n", width, spec.Type, strings.ReplaceAll(spec.Regex, "?", "{0,1}"))
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteEBNF(t *testing.T) {
+	var out strings.Builder
+	writeEBNF(&out)
+	ebnf := out.String()
+	for _, rule := range grammar {
+		if !strings.Contains(ebnf, " = "+rule.Body+" ;\n") {
+			t.Errorf("rule %s missing from the grammar", rule.Name)
+		}
+	}
+	for _, spec := range tokenSpecs {
+		listed := strings.Contains(ebnf, "\n"+spec.Type+" ")
+		trivia := map[string]bool{"OPEN_STRING": true, "OPEN_RAW_STRING": true, "COMMENT": true, "BLOCK_COMMENT": true, "NEWLINE": true, "SKIP": true, "MISMATCH": true}[spec.Type]
+		if listed == trivia {
+			t.Errorf("token %s listed: %v, want %v", spec.Type, listed, !trivia)
+		}
+	}
+	// A ? inside a special sequence would end it early.
+	for _, line := range strings.Split(ebnf, "\n") {
+		if i := strings.Index(line, "? /"); i >= 0 && strings.Contains(line[i+3:strings.LastIndex(line, "/ ?")], "?") {
+			t.Errorf("special sequence contains ?: %s", line)
+		}
+	}
+}
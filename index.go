@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+/*
+   INDEX COMMAND
+   -------------
+   `xsharp index file.xs...` writes a ctags file listing where every class,
+   function, method, field and global is defined, and where each of those
+   names is used, so editors without a language server and code-search tools
+   can jump to definitions and find references. References are found by name,
+   so a local variable that shadows an indexed name is listed too.
+*/
+
+// tag is one definition in the index.
+type tag struct {
+	Name  string // The defined name.
+	File  string // File of the definition.
+	Line  int    // Line of the definition.
+	Kind  string // ctags kind letter: c class, f function, m member, v variable, r reference.
+	Class string // Class a member belongs to, or "".
+}
+
+// runIndex implements the index subcommand.
+func runIndex(args []string) {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	output := fs.String("o", "tags", "write the index to `file`; - for standard output")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: compiler index [flags] <input_file>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	var tags []tag
+	sources := make(map[string]string)
+	for _, inputFile := range fs.Args() {
+		data, err := ioutil.ReadFile(inputFile)
+		if err != nil {
+			fail(fmt.Errorf("Error reading input file: %v", err))
+		}
+		ast, err := parseSource(string(data), inputFile, ParseOptions{})
+		if err != nil {
+			fail(fmt.Errorf("%s: %v", inputFile, err))
+		}
+		sources[inputFile] = string(data)
+		tags = append(tags, definitions(ast, inputFile)...)
+	}
+	// References come after the definitions, so that a stable sort keeps
+	// the definition first among the tags for a name.
+	refs := references(fs.Args(), sources, tags)
+	tags = append(tags, refs...)
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+
+	if *output == "-" {
+		writeTags(os.Stdout, tags)
+		return
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		fail(fmt.Errorf("Error writing index: %v", err))
+	}
+	writeTags(f, tags)
+	if err := f.Close(); err != nil {
+		fail(fmt.Errorf("Error writing index: %v", err))
+	}
+}
+
+// definitions returns the top-level declarations of a program, and the
+// members of its classes, as tags.
+func definitions(ast Program, file string) []tag {
+	var tags []tag
+	for _, decl := range ast.Declarations {
+		switch d := decl.(type) {
+		case ClassDecl:
+			tags = append(tags, tag{Name: d.Name, File: file, Line: d.Line, Kind: "c"})
+			for _, mem := range d.Members {
+				switch m := mem.(type) {
+				case FunctionDecl:
+					tags = append(tags, tag{Name: m.Name, File: file, Line: m.Line, Kind: "m", Class: d.Name})
+				case VarDecl:
+					tags = append(tags, tag{Name: m.Name, File: file, Line: m.Line, Kind: "m", Class: d.Name})
+				}
+			}
+		case FunctionDecl:
+			tags = append(tags, tag{Name: d.Name, File: file, Line: d.Line, Kind: "f"})
+		case VarDecl:
+			tags = append(tags, tag{Name: d.Name, File: file, Line: d.Line, Kind: "v"})
+		}
+	}
+	return tags
+}
+
+// references returns a tag for each line of the given files that uses a
+// name defs defines, other than at a definition itself.
+func references(files []string, sources map[string]string, defs []tag) []tag {
+	defined := make(map[string]bool)
+	sites := make(map[tag]bool) // Definitions and references, by name, file and line.
+	for _, d := range defs {
+		defined[d.Name] = true
+		sites[tag{Name: d.Name, File: d.File, Line: d.Line}] = true
+	}
+	var refs []tag
+	for _, file := range files {
+		// The file parsed, so it lexes without errors.
+		tokens, _ := tokenize(sources[file], LexOptions{})
+		for _, tok := range tokens {
+			ref := tag{Name: tok.Value, File: file, Line: tok.Line}
+			if tok.Type == "ID" && defined[tok.Value] && !sites[ref] {
+				sites[ref] = true
+				ref.Kind = "r"
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+// writeTags writes tags, which must be sorted by name, in the extended
+// ctags format: name, file and line number, then the kind and class.
+func writeTags(w io.Writer, tags []tag) {
+	fmt.Fprintln(w, "!_TAG_FILE_FORMAT\t2\t/extended format/")
+	fmt.Fprintln(w, "!_TAG_FILE_SORTED\t1\t/0=unsorted, 1=sorted/")
+	fmt.Fprintf(w, "!_TAG_PROGRAM_NAME\txsharp\t/%s/\n", versionString())
+	for _, t := range tags {
+		fmt.Fprintf(w, "%s\t%s\t%d;\"\t%s", t.Name, t.File, t.Line, t.Kind)
+		if t.Class != "" {
+			fmt.Fprintf(w, "\tclass:%s", t.Class)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	source := `class Point {
+    int x;
+    int getX() {
+        return this.x;
+    }
+}
+int origin = 0;
+int main() {
+    Point p;
+    return p.getX() + origin + origin;
+}
+`
+	ast, err := parseSource(source, "a.xs", ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := definitions(ast, "a.xs")
+	tags = append(tags, references([]string{"a.xs"}, map[string]string{"a.xs": source}, tags)...)
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	var out strings.Builder
+	writeTags(&out, tags)
+	want := "Point\ta.xs\t1;\"\tc\n" +
+		"Point\ta.xs\t9;\"\tr\n" +
+		"getX\ta.xs\t3;\"\tm\tclass:Point\n" +
+		"getX\ta.xs\t10;\"\tr\n" +
+		"main\ta.xs\t8;\"\tf\n" +
+		"origin\ta.xs\t7;\"\tv\n" +
+		"origin\ta.xs\t10;\"\tr\n" +
+		"x\ta.xs\t2;\"\tm\tclass:Point\n" +
+		"x\ta.xs\t4;\"\tr\n"
+	got := out.String()
+	// Skip the header, whose program line holds the version.
+	got = got[strings.Index(got, "Point"):]
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/*
+   LINT COMMAND
+   ------------
+   `xsharp lint file.xs` checks that names follow the naming conventions:
+   PascalCase for classes and camelCase for functions, methods, parameters
+   and variables. Each rule can be turned off with --rules.
+*/
+
+// lintRules maps each rule name to the case style it enforces.
+var lintRules = map[string]string{
+	"class-case":    "PascalCase",
+	"function-case": "camelCase",
+	"variable-case": "camelCase",
+}
+
+// lintFinding is a name that breaks a lint rule.
+type lintFinding struct {
+	Line int    // Line of the name.
+	Rule string // The rule broken, a key of lintRules.
+	Kind string // What the name belongs to, e.g. "class" or "parameter".
+	Name string // The offending name.
+}
+
+func (f lintFinding) String() string {
+	style := lintRules[f.Rule]
+	return fmt.Sprintf("%s name %s should be %s, e.g. %s [%s]", f.Kind, f.Name, style, toCase(f.Name, style), f.Rule)
+}
+
+// runLint implements the lint subcommand.
+func runLint(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	var names []string
+	for name := range lintRules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rules := fs.String("rules", strings.Join(names, ","), "comma-separated `list` of rules to check")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: compiler lint [flags] <input_file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	enabled := make(map[string]bool)
+	for _, rule := range strings.Split(*rules, ",") {
+		if rule == "" {
+			continue
+		}
+		if _, ok := lintRules[rule]; !ok {
+			fmt.Fprintf(os.Stderr, "unknown lint rule %q; known rules are %s\n", rule, strings.Join(names, ", "))
+			os.Exit(exitUsage)
+		}
+		enabled[rule] = true
+	}
+
+	inputFile := fs.Arg(0)
+	data, err := ioutil.ReadFile(inputFile)
+	if err != nil {
+		fail(fmt.Errorf("Error reading input file: %v", err))
+	}
+	ast, err := parseSource(string(data), inputFile, ParseOptions{})
+	if err != nil {
+		fail(err)
+	}
+	findings := 0
+	for _, f := range lintNames(ast) {
+		if enabled[f.Rule] {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", inputFile, f.Line, f)
+			findings++
+		}
+	}
+	if findings > 0 {
+		os.Exit(exitDiagnostics)
+	}
+}
+
+// lintNames checks every declared name in the program against all the rules,
+// returning the findings in source order.
+func lintNames(ast Program) []lintFinding {
+	var findings []lintFinding
+	check := func(line int, rule, kind, name string) {
+		if !hasCase(name, lintRules[rule]) {
+			findings = append(findings, lintFinding{Line: line, Rule: rule, Kind: kind, Name: name})
+		}
+	}
+	checkFunction := func(fn FunctionDecl, kind string) {
+		check(fn.Line, "function-case", kind, fn.Name)
+		for _, param := range fn.Params {
+			check(param.Line, "variable-case", "parameter", param.Name)
+		}
+		eachVarDecl(fn.Body, func(v VarDecl) {
+			check(v.Line, "variable-case", "variable", v.Name)
+		})
+	}
+	for _, decl := range ast.Declarations {
+		switch d := decl.(type) {
+		case ClassDecl:
+			check(d.Line, "class-case", "class", d.Name)
+			for _, mem := range d.Members {
+				switch m := mem.(type) {
+				case FunctionDecl:
+					checkFunction(m, "method")
+				case VarDecl:
+					check(m.Line, "variable-case", "field", m.Name)
+				}
+			}
+		case FunctionDecl:
+			checkFunction(d, "function")
+		case VarDecl:
+			check(d.Line, "variable-case", "global", d.Name)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Line < findings[j].Line })
+	return findings
+}
+
+// eachVarDecl calls visit for each variable declared in body, including in
+// nested blocks.
+func eachVarDecl(body []Node, visit func(VarDecl)) {
+	for _, stmt := range body {
+		switch s := stmt.(type) {
+		case VarDecl:
+			visit(s)
+		case IfStmt:
+			eachVarDecl(s.Then, visit)
+			eachVarDecl(s.Else, visit)
+		case WhileStmt:
+			eachVarDecl(s.Body, visit)
+		case BlockStmt:
+			eachVarDecl(s.Body, visit)
+		case SwitchStmt:
+			for _, clause := range s.Cases {
+				eachVarDecl(clause.Body, visit)
+			}
+		}
+	}
+}
+
+// hasCase reports whether name is written in the given case style: letters
+// and digits only, starting with an upper-case letter for PascalCase and a
+// lower-case one for camelCase.
+func hasCase(name, style string) bool {
+	for i, r := range name {
+		switch {
+		case i == 0 && style == "PascalCase" && !unicode.IsUpper(r):
+			return false
+		case i == 0 && style == "camelCase" && !unicode.IsLower(r):
+			return false
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			return false
+		}
+	}
+	return true
+}
+
+// toCase rewrites name in the given case style, treating underscores as
+// word breaks: my_class becomes MyClass or myClass.
+func toCase(name, style string) string {
+	words := strings.FieldsFunc(name, func(r rune) bool { return r == '_' })
+	var out strings.Builder
+	for i, word := range words {
+		runes := []rune(word)
+		if i == 0 && style == "camelCase" {
+			runes[0] = unicode.ToLower(runes[0])
+		} else {
+			runes[0] = unicode.ToUpper(runes[0])
+		}
+		// SCREAMING words are lowered so only their first letter stays upper.
+		if strings.ToUpper(word) == word {
+			for j := 1; j < len(runes); j++ {
+				runes[j] = unicode.ToLower(runes[j])
+			}
+		}
+		out.WriteString(string(runes))
+	}
+	return out.String()
+}
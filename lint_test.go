@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLintNames(t *testing.T) {
+	source := `class point_t {
+    int X;
+    int getX(int Scale) {
+        int total_x = this.X * Scale;
+        return total_x;
+    }
+}
+int Main() {
+    if (1 == 1) {
+        int okName = 0;
+        int Bad = okName;
+    }
+    return 0;
+}
+`
+	ast, err := parseSource(source, "test.xs", ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range lintNames(ast) {
+		got = append(got, f.String())
+	}
+	want := []string{
+		"class name point_t should be PascalCase, e.g. PointT [class-case]",
+		"field name X should be camelCase, e.g. x [variable-case]",
+		"parameter name Scale should be camelCase, e.g. scale [variable-case]",
+		"variable name total_x should be camelCase, e.g. totalX [variable-case]",
+		"function name Main should be camelCase, e.g. main [function-case]",
+		"variable name Bad should be camelCase, e.g. bad [variable-case]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got findings\n%q\nwant\n%q", got, want)
+	}
+}
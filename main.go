@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 /*
@@ -18,10 +27,13 @@ import (
 
 // Token struct holds the type, value, and location of each token.
 type Token struct {
-	Type   string // The type of token, e.g., "ID", "NUMBER", etc.
-	Value  string // The literal value of the token.
-	Line   int    // Line number where the token was found.
-	Column int    // Column position in the line.
+	Type   string `json:"type"`   // The type of token, e.g., "ID", "NUMBER", etc.
+	Value  string `json:"value"`  // The literal value of the token.
+	Line   int    `json:"line"`   // Line number where the token was found.
+	Column int    `json:"column"` // Column position in the line.
+	// Comments directly before the token, in order. They are only kept
+	// when tokenizing with LexOptions.KeepComments.
+	Comments []string `json:"comments,omitempty"`
 }
 
 // tokenSpecs defines regex patterns for each type of token.
@@ -30,74 +42,572 @@ var tokenSpecs = []struct {
 	Type  string
 	Regex string
 }{
-	{"NUMBER", `\d+(\.\d*)?`},        // Integer or floating-point numbers.
-	{"STRING", `"([^"\\]|\\.)*"`},    // Double-quoted strings with escapes.
+	// Integer or floating-point numbers, with optional exponent and type suffix.
+	// Underscores may separate digits for readability.
+	{"NUMBER", `\d[\d_]*(\.[\d_]*)?([eE][+-]?\d[\d_]*)?[fFuUlL]*`},
+	{"STRING", `"([^"\\\n]|\\.)*"`},          // Double-quoted strings with escapes.
+	{"OPEN_STRING", `"([^"\\\n]|\\.)*`},      // A string missing its closing quote on this line.
+	{"INTERP_STRING", `\$"([^"\\\n]|\\.)*"`}, // Interpolated strings: $"x is {x}".
+	{"PATH_STRING", `p"[^"\n]*"`},            // Path literals: p"C:\dir", backslashes kept.
+	{"RAW_STRING", "`[^`]*`"},                // Backtick raw strings, which may span lines.
+	{"OPEN_RAW_STRING", "`"},                 // A raw string with no closing backtick.
+	// Single-quoted character literals, with the escapes C allows.
+	{"CHAR", `'([^'\\\n]|\\u[0-9A-Fa-f]{4}|\\x[0-9A-Fa-f]+|\\[0-7]{1,3}|\\.)'`},
 	{"ID", `[A-Za-z_][A-Za-z0-9_]*`}, // Identifiers: names for variables, functions, etc.
-	{"OP", `[+\-*/=<>!]`},            // Operators like +, -, *, /, etc.
+	{"COMMENT", `//[^\r\n]*`},        // Single-line comments, up to the end of the line.
+	{"BLOCK_COMMENT", `/\*`},         // Block comment opener; the rest is matched by blockCommentEnd.
+	{"EQ", `==`},                     // Equality comparison.
+	{"NEQ", `!=`},                    // Inequality comparison.
+	{"LE", `<=`},                     // Less-than-or-equal comparison.
+	{"GE", `>=`},                     // Greater-than-or-equal comparison.
+	{"LOGICAL_OP", `&&|\|\|`},        // Logical and/or.
+	{"SHIFT", `<<|>>`},               // Bitwise shifts.
+	{"ARROW", `->`},                  // Arrow, for trailing return types.
+	{"FAT_ARROW", `=>`},              // Fat arrow, for lambdas.
+	{"DOUBLECOLON", `::`},            // Scope resolution, as in math::sqrt.
+	{"INCDEC", `\+\+|--`},            // Increment and decrement.
+	{"ASSIGN_OP", `[+\-*/%]=`},       // Compound assignment, e.g. +=.
+	{"OP", `[+\-*/%=<>!&|^~]`},       // Operators like +, -, *, /, &, etc.
 	{"LPAREN", `\(`},                 // Left parenthesis.
 	{"RPAREN", `\)`},                 // Right parenthesis.
 	{"LBRACE", `{`},                  // Left brace.
 	{"RBRACE", `}`},                  // Right brace.
+	{"LBRACKET", `\[`},               // Left square bracket.
+	{"RBRACKET", `\]`},               // Right square bracket.
 	{"LANGLE", `<`},                  // Less-than sign.
 	{"RANGLE", `>`},                  // Greater-than sign.
 	{"COLON", `:`},                   // Colon, used in class inheritance.
 	{"SEMICOLON", `;`},               // Semicolon, ends statements.
 	{"COMMA", `,`},                   // Comma, separates parameters, etc.
-	{"NEWLINE", `\n`},                // Newline characters.
+	{"DOT", `\.`},                    // Dot, for member access.
+	{"NEWLINE", `\r?\n`},             // Line ends, including Windows CRLF ones.
 	{"SKIP", `[ \t]+`},               // Skip over spaces and tabs.
 	{"MISMATCH", `.`},                // Any other character (error if encountered).
 }
 
-// tokenize function scans the input code and produces a slice of Tokens.
-func tokenize(code string) ([]Token, error) {
-	var tokens []Token
-	// Create a combined regex pattern for all token types.
+// keywords maps each reserved word to its token type. Keywords are first
+// matched by the ID rule and then reclassified using this table.
+var keywords = map[string]string{
+	"class":       "CLASS",
+	"if":          "IF",
+	"else":        "ELSE",
+	"while":       "WHILE",
+	"for":         "FOR",
+	"return":      "RETURN",
+	"public":      "PUBLIC",
+	"private":     "PRIVATE",
+	"static":      "STATIC",
+	"virtual":     "VIRTUAL",
+	"override":    "OVERRIDE",
+	"new":         "NEW",
+	"delete":      "DELETE",
+	"readonly":    "READONLY",
+	"switch":      "SWITCH",
+	"case":        "CASE",
+	"default":     "DEFAULT",
+	"fallthrough": "FALLTHROUGH",
+}
+
+// LexError is a problem with the source text found by tokenize.
+type LexError struct {
+	Msg    string // What is wrong.
+	Line   int    // Line of the offending text.
+	Column int    // Column of the offending text.
+}
+
+func (e LexError) Error() string {
+	return fmt.Sprintf("%s at line %d, col %d", e.Msg, e.Line, e.Column)
+}
+
+// LexErrors is every LexError found in one pass over the source.
+type LexErrors []LexError
+
+func (l LexErrors) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// LexOptions holds settings for tokenize and NewLexer.
+type LexOptions struct {
+	// KeepComments attaches comments to the token that follows them as
+	// Token.Comments, for tools that need them, instead of dropping them.
+	KeepComments bool
+	// TabWidth is the distance between tab stops when computing columns;
+	// 0 means defaultTabWidth.
+	TabWidth int
+}
+
+// defaultTabWidth is the tab width used for columns unless configured.
+const defaultTabWidth = 8
+
+// tokenRegex combines all the token specs into one regex, with a named
+// group per token type.
+var tokenRegex = compileTokenSpecs()
+
+func compileTokenSpecs() *regexp.Regexp {
 	var patterns []string
 	for _, spec := range tokenSpecs {
 		// The regex is named with the token type.
 		patterns = append(patterns, fmt.Sprintf("(?P<%s>%s)", spec.Type, spec.Regex))
 	}
-	regex := regexp.MustCompile(strings.Join(patterns, "|"))
+	return regexp.MustCompile(strings.Join(patterns, "|"))
+}
+
+// Lexer reads tokens one at a time from an io.Reader, holding only the
+// current line in memory, plus the rest of any block comment or raw string
+// that spans several lines.
+type Lexer struct {
+	r        *bufio.Reader
+	opts     LexOptions
+	buf      string   // Unread input: whole lines, except at the end of input.
+	started  bool     // The first line has been read.
+	eof      bool     // r has no more input.
+	err      error    // A read error, returned from then on.
+	line     int      // Line of buf[0].
+	col      int      // Column of buf[0], in characters with tabs expanded.
+	offset   int      // Byte offset of buf[0] in the input.
+	comments []string // Kept comments waiting for the next token.
+}
+
+// NewLexer returns a Lexer reading source text from r.
+func NewLexer(r io.Reader, opts LexOptions) *Lexer {
+	if opts.TabWidth <= 0 {
+		opts.TabWidth = defaultTabWidth
+	}
+	return &Lexer{r: bufio.NewReader(r), opts: opts, line: 1}
+}
+
+// fill reads the next line onto the unread input. It reports false when
+// there is nothing left to read.
+func (lx *Lexer) fill() bool {
+	if lx.eof || lx.err != nil {
+		return false
+	}
+	text, err := lx.r.ReadString('\n')
+	if err == io.EOF {
+		lx.eof = true
+	} else if err != nil {
+		lx.err = err
+		return false
+	}
+	if !lx.started {
+		lx.started = true
+		// Editors on Windows may start UTF-8 files with a byte order mark.
+		if strings.HasPrefix(text, "\uFEFF") {
+			text = text[len("\uFEFF"):]
+			lx.offset = len("\uFEFF")
+		}
+		// A leading #! line lets scripts be run directly; drop it but keep
+		// its newline so line numbers are unchanged.
+		if strings.HasPrefix(text, "#!") {
+			shebang := strings.TrimRight(text, "\n")
+			text = text[len(shebang):]
+			lx.offset += len(shebang)
+		}
+	}
+	lx.buf += text
+	return text != "" || !lx.eof
+}
+
+// advance consumes n bytes of unread input, keeping the position current.
+func (lx *Lexer) advance(n int) {
+	lx.line, lx.col = lx.positionAfter(lx.line, lx.col, lx.buf[:n])
+	lx.buf = lx.buf[n:]
+	lx.offset += n
+}
+
+// positionAfter returns the line and column reached by reading text from
+// the given line and column.
+func (lx *Lexer) positionAfter(line, col int, text string) (int, int) {
+	if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+		line += strings.Count(text, "\n")
+		col, text = 0, text[i+1:]
+	}
+	return line, lx.columnAfter(col, text)
+}
 
-	line := 1      // Current line number.
-	lineStart := 0 // Position of the start of the current line.
+// columnAfter returns the column reached by reading text, which contains no
+// newlines, from column col. Columns count characters rather than bytes, and
+// a tab moves to the next tab stop.
+func (lx *Lexer) columnAfter(col int, text string) int {
+	for _, r := range text {
+		if r == '\t' {
+			col += lx.opts.TabWidth - col%lx.opts.TabWidth
+		} else {
+			col++
+		}
+	}
+	return col
+}
 
-	// Find all regex matches in the code.
-	matches := regex.FindAllStringSubmatchIndex(code, -1)
-	for _, match := range matches {
-		// match[0] and match[1] are the start and end positions of the full match.
-		fullStart, fullEnd := match[0], match[1]
-		value := code[fullStart:fullEnd]
+// Next returns the next token. Bad input is reported as a LexError and
+// skipped, so calling Next again carries on after it. At the end of input
+// Next returns an EOF token, which holds any comments after the last token.
+func (lx *Lexer) Next() (Token, error) {
+	for {
+		if lx.buf == "" && !lx.fill() {
+			if lx.err != nil {
+				return Token{}, lx.err
+			}
+			tok := Token{Type: "EOF", Value: "", Line: lx.line, Column: 0, Comments: lx.comments}
+			lx.comments = nil
+			return tok, nil
+		}
+		match := tokenRegex.FindStringSubmatchIndex(lx.buf)
+		value := lx.buf[match[0]:match[1]]
 		var tokType string
-		// Loop over each token spec to see which one matched.
-		for i, spec := range tokenSpecs {
-			// Each group index for token i is at positions 2*(i+1) and 2*(i+1)+1.
-			start, end := match[2*(i+1)], match[2*(i+1)+1]
-			if start != -1 && end != -1 {
-				tokType = spec.Type
+		// Loop over the named groups to see which token spec matched.
+		// Specs may contain their own capture groups, so groups are looked
+		// up by name rather than by position.
+		for i, name := range tokenRegex.SubexpNames() {
+			if name != "" && match[2*i] != -1 {
+				tokType = name
 				break
 			}
 		}
-		col := fullStart - lineStart // Calculate the column based on line start.
+		if kw, ok := keywords[value]; ok && tokType == "ID" {
+			tokType = kw // Reserved words get their own token type.
+		}
+		line, col, offset := lx.line, lx.col, lx.offset
+		switch tokType {
+		case "BLOCK_COMMENT":
+			end := blockCommentEnd(lx.buf, 0)
+			if end < 0 {
+				if lx.fill() {
+					continue // The comment may close on a later line.
+				}
+				// Report the opening delimiter rather than whatever follows
+				// it; the rest of the file is inside the comment.
+				lx.advance(len(lx.buf))
+				return Token{}, LexError{"unterminated block comment starting", line, col}
+			}
+			value = lx.buf[:end]
+		case "OPEN_RAW_STRING":
+			if lx.fill() {
+				continue // The closing backtick may be on a later line.
+			}
+			// The rest of the file is inside the string.
+			lx.advance(len(lx.buf))
+			return Token{}, LexError{"unterminated raw string literal starting", line, col}
+		}
+		lx.advance(len(value))
+		if !utf8.ValidString(value) {
+			// Point at the bad byte itself, wherever it is in the token.
+			bad := 0
+			for {
+				r, size := utf8.DecodeRuneInString(value[bad:])
+				if r == utf8.RuneError && size == 1 {
+					break
+				}
+				bad += size
+			}
+			line, col := lx.positionAfter(line, col, value[:bad])
+			return Token{}, LexError{fmt.Sprintf("invalid UTF-8 byte 0x%02x (byte offset %d)", value[bad], offset+bad), line, col}
+		}
+
+		tok := Token{Type: tokType, Value: value, Line: line, Column: col}
 		switch tokType {
-		case "SKIP":
-			// Do nothing for spaces and tabs.
-		case "NEWLINE":
-			line++              // Increment line count.
-			lineStart = fullEnd // Update the start position for the new line.
+		case "SKIP", "NEWLINE":
+			// Spaces, tabs and line ends only separate tokens.
+			continue
+		case "COMMENT", "BLOCK_COMMENT":
+			if lx.opts.KeepComments {
+				lx.comments = append(lx.comments, value)
+			}
+			continue
+		case "RAW_STRING":
+			// Raw strings become ordinary string tokens, escaped so that C
+			// sees the same characters on a single line. As in Go, line ends
+			// are \n even in a file saved with CRLF ones.
+			tok.Type, tok.Value = "STRING", rawToC(strings.ReplaceAll(value, "\r\n", "\n"))
+		case "PATH_STRING":
+			// Path literals are verbatim, so Windows separators need no
+			// escaping; they are escaped here for C like raw strings.
+			tok.Type, tok.Value = "STRING", rawToC(value[1:])
+		case "OPEN_STRING":
+			// The match stops at the end of the line, so lexing resumes on
+			// the next line rather than pairing this quote with a later one.
+			return Token{}, LexError{"unterminated string literal starting", line, col}
+		case "NUMBER":
+			// Check the type suffix and keep it on the value for codegen.
+			num, err := normalizeNumber(value)
+			if err != nil {
+				return Token{}, LexError{err.Error(), line, col}
+			}
+			tok.Value = num
+		case "STRING", "CHAR", "INTERP_STRING":
+			// Reject escape sequences C would not understand the same way.
+			if off, err := checkEscapes(value); err != nil {
+				return Token{}, LexError{err.Error(), line, lx.columnAfter(col, value[:off])}
+			}
+			if tokType == "CHAR" && !charFits(value) {
+				return Token{}, LexError{fmt.Sprintf("character literal %s does not fit in a char; use a string", value), line, col}
+			}
 		case "MISMATCH":
-			// Report an error for unrecognized characters.
-			return nil, fmt.Errorf("unexpected token %q at line %d, col %d", value, line, col)
-		default:
-			// Append the token to our tokens slice.
-			tokens = append(tokens, Token{Type: tokType, Value: value, Line: line, Column: col})
+			// Report unrecognized characters and skip over them.
+			return Token{}, LexError{fmt.Sprintf("unexpected token %q", value), line, col}
+		}
+		tok.Comments, lx.comments = lx.comments, nil
+		return tok, nil
+	}
+}
+
+// tokenize function scans the input code and produces a slice of Tokens.
+// Lexing carries on past bad input, so all of it is reported at once: the
+// error, if any, is a LexErrors, and the tokens found are returned with it.
+func tokenize(code string, opts LexOptions) ([]Token, error) {
+	var tokens []Token
+	var errs LexErrors
+	lx := NewLexer(strings.NewReader(code), opts)
+	for {
+		tok, err := lx.Next()
+		if err != nil {
+			// Reading from a string cannot fail, so this is a LexError.
+			errs = append(errs, err.(LexError))
+			continue
+		}
+		tokens = append(tokens, tok)
+		if tok.Type == "EOF" {
+			break
 		}
 	}
-	// Append an "EOF" (end-of-file) token to signal the end of input.
-	tokens = append(tokens, Token{Type: "EOF", Value: "", Line: line, Column: 0})
+	if len(errs) > 0 {
+		return tokens, errs
+	}
 	return tokens, nil
 }
 
+// blockCommentEnd returns the position just past the block comment that
+// opens at start. Block comments nest, so code that already contains
+// comments can be commented out. It returns -1 if the comment is unclosed.
+func blockCommentEnd(code string, start int) int {
+	depth := 0
+	for i := start; i+1 < len(code); i++ {
+		switch code[i : i+2] {
+		case "/*":
+			depth++
+			i++
+		case "*/":
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// rawEscaper escapes the characters of a raw string that cannot appear
+// as-is inside a C string literal.
+var rawEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// rawToC converts a backtick raw string into an equivalent C string literal.
+func rawToC(raw string) string {
+	return `"` + rawEscaper.Replace(raw[1:len(raw)-1]) + `"`
+}
+
+// charFits reports whether the character literal lit, with valid escapes,
+// holds a single byte. Other characters would become multi-byte C character
+// constants, whose value is up to the compiler, so a char holds only ASCII
+// code points and escapes up to \xff.
+func charFits(lit string) bool {
+	body := lit[1 : len(lit)-1]
+	var code uint64
+	switch {
+	case strings.HasPrefix(body, `\u`):
+		code, _ = strconv.ParseUint(body[2:], 16, 32)
+		return code <= 0x7f
+	case strings.HasPrefix(body, `\x`):
+		code, _ = strconv.ParseUint(body[2:], 16, 64)
+	case len(body) > 1 && body[0] == '\\' && body[1] >= '0' && body[1] <= '7':
+		code, _ = strconv.ParseUint(body[1:], 8, 32)
+	case body[0] >= utf8.RuneSelf:
+		return false
+	}
+	return code <= 0xff
+}
+
+// checkEscapes validates the escape sequences in a string or character
+// literal. On failure it also returns the byte offset of the bad escape.
+func checkEscapes(lit string) (int, error) {
+	for i := 0; i < len(lit); i++ {
+		if lit[i] != '\\' {
+			continue
+		}
+		start := i
+		i++ // Move onto the character after the backslash.
+		switch c := lit[i]; {
+		case strings.IndexByte(`ntrabfv\'"?`, c) >= 0:
+			// Simple single-character escape.
+		case c >= '0' && c <= '7':
+			// Octal escape of up to three digits.
+			for n := 1; n < 3 && i+1 < len(lit) && lit[i+1] >= '0' && lit[i+1] <= '7'; n++ {
+				i++
+			}
+		case c == 'x':
+			n := countHex(lit[i+1:], len(lit))
+			if n == 0 {
+				return start, fmt.Errorf("\\x escape needs at least one hex digit")
+			}
+			i += n
+		case c == 'u' || c == 'U':
+			want := 4
+			if c == 'U' {
+				want = 8
+			}
+			if countHex(lit[i+1:], want) != want {
+				return start, fmt.Errorf("\\%c escape needs exactly %d hex digits", c, want)
+			}
+			code, _ := strconv.ParseUint(lit[i+1:i+1+want], 16, 32)
+			if !utf8.ValidRune(rune(code)) {
+				return start, fmt.Errorf("escape %s is not a valid unicode code point", lit[start:i+1+want])
+			}
+			i += want
+		default:
+			return start, fmt.Errorf("invalid escape sequence \\%c", c)
+		}
+	}
+	return 0, nil
+}
+
+// countHex returns how many leading hex digits s has, up to limit.
+func countHex(s string, limit int) int {
+	n := 0
+	for n < len(s) && n < limit && strings.IndexByte("0123456789abcdefABCDEF", s[n]) >= 0 {
+		n++
+	}
+	return n
+}
+
+// badDigitSeparator matches an underscore in a numeric literal that is not
+// between two digits.
+var badDigitSeparator = regexp.MustCompile(`_([^\d_]|$)|[^\d_]_`)
+
+// normalizeNumber validates the type suffix of a numeric literal and rewrites
+// the literal into a form C accepts with the same type. Digit separators are
+// removed, and since C only allows an f suffix on floating-point literals,
+// 42f becomes 42.0f.
+func normalizeNumber(lit string) (string, error) {
+	if strings.Contains(lit, "_") {
+		if badDigitSeparator.MatchString(lit) {
+			return "", fmt.Errorf("digit separator must be between digits in %s", lit)
+		}
+		lit = strings.ReplaceAll(lit, "_", "")
+	}
+	digits := strings.TrimRight(lit, "fFuUlL")
+	suffix := lit[len(digits):]
+	isFloat := strings.ContainsAny(digits, ".eE")
+	switch strings.ToLower(suffix) {
+	case "", "l":
+		// No suffix, or long (long double for floating-point literals).
+	case "f":
+		if !isFloat {
+			digits += ".0"
+			isFloat = true
+		}
+	case "u", "ul", "lu", "ll", "ull", "llu":
+		if isFloat {
+			return "", fmt.Errorf("invalid suffix %q on floating-point literal %s", suffix, lit)
+		}
+	default:
+		return "", fmt.Errorf("invalid suffix %q on numeric literal %s", suffix, lit)
+	}
+	// Whatever the target type, the value must be representable at all.
+	if isFloat {
+		if _, err := strconv.ParseFloat(digits, 64); err != nil {
+			return "", fmt.Errorf("literal %s overflows float64", lit)
+		}
+	} else if _, err := strconv.ParseUint(digits, 10, 64); err != nil {
+		return "", fmt.Errorf("literal %s overflows uint64", lit)
+	}
+	return digits + suffix, nil
+}
+
+// insertSemicolons implements the --auto-semicolons mode. Like Go, it inserts
+// a semicolon at the end of a line whose last token can end a statement, and
+// also at the end of the file and before a } closing a block on the same
+// line. Nothing is inserted inside parentheses or object literals, before
+// an opening brace, or after an attribute such as [immutable], so multi-line
+// parameter lists, braces on their own line and attributes on their own
+// line keep working.
+func insertSemicolons(tokens []Token) []Token {
+	var out []Token
+	depth := 0         // Nesting depth of parentheses and object literals.
+	var braces []bool  // For each open brace, whether it opens an object literal.
+	attribute := false // Inside the brackets of a top-level attribute.
+	for i, tok := range tokens {
+		out = append(out, tok)
+		ends := endsStatement(tok)
+		switch tok.Type {
+		case "LBRACKET":
+			// Outside any braces only an attribute starts with [.
+			attribute = len(braces) == 0 && depth == 0
+		case "RBRACKET":
+			if attribute {
+				ends, attribute = false, false
+			}
+		case "LPAREN":
+			depth++
+		case "RPAREN":
+			depth--
+		case "LBRACE":
+			literal := i > 0 && opensLiteral(tokens[i-1], braces)
+			braces = append(braces, literal)
+			if literal {
+				depth++
+			}
+		case "RBRACE":
+			if n := len(braces); n > 0 {
+				if braces[n-1] {
+					depth--
+					ends = true // An object literal can end a statement.
+				}
+				braces = braces[:n-1]
+			}
+		}
+		if i+1 == len(tokens) {
+			break
+		}
+		next := tokens[i+1]
+		closesBlock := next.Type == "RBRACE" && len(braces) > 0 && !braces[len(braces)-1]
+		atEnd := next.Line != tok.Line || next.Type == "EOF" || closesBlock
+		if depth > 0 || !atEnd || !ends {
+			continue
+		}
+		if next.Type == "SEMICOLON" || next.Type == "LBRACE" {
+			continue
+		}
+		out = append(out, Token{Type: "SEMICOLON", Value: ";", Line: tok.Line, Column: tok.Column + len(tok.Value)})
+	}
+	return out
+}
+
+// opensLiteral reports whether a { following prev starts an object literal
+// rather than a block, given the braces already open.
+func opensLiteral(prev Token, braces []bool) bool {
+	switch prev.Type {
+	case "OP", "ASSIGN_OP", "LPAREN", "COMMA", "RETURN":
+		return true
+	case "COLON":
+		// A field value inside a literal, rather than a case label.
+		return len(braces) > 0 && braces[len(braces)-1]
+	}
+	return false
+}
+
+// endsStatement reports whether a statement can end with tok.
+func endsStatement(tok Token) bool {
+	switch tok.Type {
+	case "ID", "NUMBER", "STRING", "CHAR", "INTERP_STRING", "RPAREN", "RBRACKET", "INCDEC", "RETURN", "FALLTHROUGH":
+		return true
+	}
+	return false
+}
+
 /*
    ABSTRACT SYNTAX TREE (AST) SECTION
    ----------------------------------
@@ -119,12 +629,15 @@ type FunctionDecl struct {
 	Name    string  // Function name.
 	Params  []Param // Parameters of the function.
 	Body    []Node  // Function body as a list of statements.
+	Private bool    // Declared private at module level.
+	Line    int     // Line of the function name.
 }
 
 // Param represents a function parameter.
 type Param struct {
 	Type string // Parameter type.
 	Name string // Parameter name.
+	Line int    // Line of the parameter name.
 }
 
 // ClassDecl represents a class declaration.
@@ -132,13 +645,18 @@ type ClassDecl struct {
 	Name    string // Class name.
 	Parent  string // Parent class name, if any.
 	Members []Node // Members: variables and functions.
+	Private bool   // Declared private at module level.
+	Line    int    // Line of the class name.
 }
 
 // VarDecl represents a variable declaration.
 type VarDecl struct {
-	VarType string     // Variable type.
-	Name    string     // Variable name.
-	Default Expression // Default value (if provided).
+	VarType  string // Variable type.
+	Name     string // Variable name.
+	Default  Node   // Default value expression, or nil if not provided.
+	Private  bool   // Declared private at module level (globals only).
+	Readonly bool   // Field that only its default or an object literal may set.
+	Line     int    // Line of the variable name.
 }
 
 // Expression represents a literal expression (number, string, or identifier).
@@ -146,9 +664,141 @@ type Expression struct {
 	Value string // The literal value.
 }
 
+// CharLiteral represents a character literal such as 'a' or '\n'.
+type CharLiteral struct {
+	Value string // The literal including its quotes.
+}
+
+// InterpolatedString represents a string such as $"x is {x}", made of
+// literal text with expressions embedded between the pieces.
+type InterpolatedString struct {
+	Text  []string // Literal text segments, one more than there are Exprs.
+	Exprs []Node   // Embedded expressions, each following the matching Text.
+}
+
+// BinaryExpr represents a binary operation such as a + b or a == b.
+type BinaryExpr struct {
+	Left  Node   // Left operand.
+	Op    string // Operator, e.g. "+" or "<=".
+	Right Node   // Right operand.
+}
+
+// UnaryExpr represents a prefix operation such as !a or ++a.
+type UnaryExpr struct {
+	Op      string // Operator, e.g. "!".
+	Operand Node   // The expression the operator applies to.
+}
+
+// PostfixExpr represents a postfix operation such as a++.
+type PostfixExpr struct {
+	Operand Node   // The expression the operator applies to.
+	Op      string // Operator, "++" or "--".
+}
+
+// AssignStmt represents an assignment such as x = 1 or x += 1.
+type AssignStmt struct {
+	Target Node   // The variable being assigned to.
+	Op     string // "=" or a compound operator such as "+=".
+	Value  Node   // The assigned expression.
+	Line   int    // Line the statement starts on.
+}
+
+// MemberAccess represents access to a field of an object, such as p.name.
+type MemberAccess struct {
+	Object Node   // The expression whose member is accessed.
+	Member string // The member name.
+}
+
+// CallExpr represents a function or method call, such as f(a, 1) or
+// p.move(1, 2).
+type CallExpr struct {
+	Callee Node   // The function called; a MemberAccess for a method.
+	Args   []Node // The arguments, in order.
+}
+
+// ObjectLiteral represents an object initializer such as { x: 1, y: 2 }.
+type ObjectLiteral struct {
+	Class  string      // The class being initialized, filled in from context by codegen.
+	Fields []FieldInit // The fields given, in source order.
+}
+
+// FieldInit is one field: value pair of an ObjectLiteral.
+type FieldInit struct {
+	Name  string // The field name.
+	Value Node   // The field's value.
+}
+
+// NewExpr represents allocation of an object on the heap, such as new Point().
+type NewExpr struct {
+	Class string // The class allocated.
+	Args  []Node // Constructor arguments.
+	Line  int    // Line of the new keyword.
+}
+
+// ScopedName represents a namespaced name such as math::sqrt.
+type ScopedName struct {
+	Parts []string // The names between the :: separators, outermost first.
+}
+
+// Index represents subscripting, such as arr[i].
+type Index struct {
+	Object Node // The expression being indexed.
+	Index  Node // The index expression.
+}
+
+// IfStmt represents if (cond) { ... } with an optional else. An else-if
+// chain is an IfStmt as the only statement of Else.
+type IfStmt struct {
+	Cond Node   // The condition.
+	Then []Node // Statements run when the condition holds.
+	Else []Node // Statements run otherwise; nil if there is no else.
+	Line int    // Line of the if keyword.
+}
+
+// WhileStmt represents while (cond) { ... }.
+type WhileStmt struct {
+	Cond Node   // The condition, checked before each iteration.
+	Body []Node // Statements run while the condition holds.
+	Line int    // Line of the while keyword.
+}
+
+// SwitchStmt represents switch (value) { case ...: ... default: ... }.
+type SwitchStmt struct {
+	Value Node         // The value being switched on.
+	Cases []CaseClause // The case and default clauses, in source order.
+	Line  int          // Line of the switch keyword.
+}
+
+// CaseClause is one case of a SwitchStmt. A clause breaks out of the switch
+// at its end unless it finishes with fallthrough.
+type CaseClause struct {
+	Value       Node   // The case value, or nil for default.
+	Body        []Node // Statements run for this case.
+	Fallthrough bool   // Whether control continues into the next clause.
+	Line        int    // Line of the case or default keyword.
+}
+
+// ReturnStmt represents return expr; or a bare return;.
+type ReturnStmt struct {
+	Value Node // The returned expression, or nil for a bare return.
+	Line  int  // Line of the return keyword.
+}
+
+// DeleteStmt represents delete expr;, which frees an object made with new.
+type DeleteStmt struct {
+	Value Node // The pointer to free.
+	Line  int  // Line of the delete keyword.
+}
+
+// BlockStmt represents a bare { ... } block, which opens a new scope.
+type BlockStmt struct {
+	Body []Node // Statements in the block.
+}
+
 // Statement wraps an expression to be used as a statement.
 type Statement struct {
-	Expr Expression // The expression statement.
+	Expr Node // The expression statement.
+	Line int  // Line the statement starts on, or 0 if generated.
 }
 
 /*
@@ -159,13 +809,15 @@ type Statement struct {
 */
 
 type Parser struct {
-	tokens []Token // All tokens from the lexer.
-	pos    int     // Current position in the token slice.
+	tokens   []Token // All tokens from the lexer.
+	pos      int     // Current position in the token slice.
+	file     string  // Source file name, used by __FILE__.
+	funcName string  // Name of the function being parsed, used by __FUNC__.
 }
 
-// NewParser returns a new Parser instance.
-func NewParser(tokens []Token) *Parser {
-	return &Parser{tokens: tokens, pos: 0}
+// NewParser returns a new Parser instance for tokens read from file.
+func NewParser(tokens []Token, file string) *Parser {
+	return &Parser{tokens: tokens, pos: 0, file: file}
 }
 
 // current returns the current token.
@@ -173,17 +825,54 @@ func (p *Parser) current() Token {
 	return p.tokens[p.pos]
 }
 
+// peek returns the token n places after the current one, or the final EOF
+// token if there are fewer left.
+func (p *Parser) peek(n int) Token {
+	if p.pos+n >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.pos+n]
+}
+
+// typeLength returns how many tokens the type at the current token spans:
+// a name followed by any number of *, as in Point**. It returns 0 if the
+// current token cannot start a type.
+func (p *Parser) typeLength() int {
+	if p.current().Type != "ID" {
+		return 0
+	}
+	n := 1
+	for p.peek(n).Type == "OP" && p.peek(n).Value == "*" {
+		n++
+	}
+	return n
+}
+
+// parseType consumes a type, a name followed by any number of *.
+func (p *Parser) parseType() string {
+	typ := p.consume("ID").Value
+	for p.current().Type == "OP" && p.current().Value == "*" {
+		typ += p.consume().Value
+	}
+	return typ
+}
+
 // consume moves to the next token and optionally checks the expected token type(s).
 func (p *Parser) consume(expectedType ...string) Token {
 	tok := p.current()
 	if len(expectedType) > 0 {
-		match := false
+		match, wantsName := false, false
 		for _, typ := range expectedType {
 			// Allow matching against token type or literal value.
 			if tok.Type == typ || tok.Value == typ {
 				match = true
 				break
 			}
+			wantsName = wantsName || typ == "ID"
+		}
+		if !match && wantsName && keywords[tok.Value] == tok.Type {
+			// A keyword where a name was expected gets a clearer message.
+			panic(fmt.Sprintf("Reserved word %q cannot be used as a name at line %d", tok.Value, tok.Line))
 		}
 		if !match {
 			panic(fmt.Sprintf("Expected %v but got %s (%s) at line %d", expectedType, tok.Type, tok.Value, tok.Line))
@@ -198,49 +887,258 @@ func (p *Parser) parse() Program {
 	var decls []Node
 	// Process tokens until we hit the EOF token.
 	for p.current().Type != "EOF" {
-		// If the token value is "class", parse a class declaration.
-		if p.current().Value == "class" {
-			decls = append(decls, p.parseClass())
-		} else {
-			decls = append(decls, p.parseFunction())
-		}
+		decls = append(decls, p.parseTopLevel())
 	}
+	checkInheritance(decls)
 	return Program{Declarations: decls}
 }
 
+// checkInheritance panics if a class inherits from itself, directly or
+// through its ancestors. Parents may be declared after their children, so
+// this runs once every class has been parsed.
+func checkInheritance(decls []Node) {
+	parents := make(map[string]string)
+	for _, decl := range decls {
+		if cls, ok := decl.(ClassDecl); ok {
+			parents[cls.Name] = cls.Parent
+		}
+	}
+	for _, decl := range decls {
+		cls, ok := decl.(ClassDecl)
+		if !ok {
+			continue
+		}
+		// A chain longer than the number of classes must loop, but the loop
+		// need not pass through cls, so stop there too.
+		for name, n := cls.Parent, 0; name != "" && n < len(parents); name, n = parents[name], n+1 {
+			if name == cls.Name {
+				panic(fmt.Sprintf("class %s inherits from itself at line %d", cls.Name, cls.Line))
+			}
+		}
+	}
+}
+
+// parseTopLevel handles a module-level declaration: a class, a function, or
+// a global variable, optionally preceded by public or private. Declarations
+// are public unless marked private. A class may also carry the [immutable]
+// attribute, which makes all of its fields readonly.
+func (p *Parser) parseTopLevel() Node {
+	immutable := false
+	if p.current().Type == "LBRACKET" {
+		p.consume("LBRACKET")
+		attr := p.consume("ID")
+		if attr.Value != "immutable" {
+			panic(fmt.Sprintf("Unknown attribute %q at line %d", attr.Value, attr.Line))
+		}
+		p.consume("RBRACKET")
+		immutable = true
+	}
+	private := false
+	if p.current().Type == "PUBLIC" || p.current().Type == "PRIVATE" {
+		private = p.consume().Type == "PRIVATE"
+	}
+	// If the token is the class keyword, parse a class declaration.
+	if p.current().Type == "CLASS" {
+		cls := p.parseClass()
+		cls.Private = private
+		if immutable {
+			for i, mem := range cls.Members {
+				if v, ok := mem.(VarDecl); ok {
+					v.Readonly = true
+					cls.Members[i] = v
+				}
+			}
+		}
+		return cls
+	}
+	if immutable {
+		panic(fmt.Sprintf("[immutable] only applies to classes, at line %d", p.current().Line))
+	}
+	if n := p.typeLength(); n > 0 && p.peek(n+1).Type == "LPAREN" {
+		fn := p.parseFunction()
+		fn.Private = private
+		return fn
+	}
+	tok := p.current()
+	global, ok := p.parseStatement().(VarDecl)
+	if !ok {
+		panic(fmt.Sprintf("Expected a class, function or variable declaration at line %d", tok.Line))
+	}
+	global.Private = private
+	return global
+}
+
 // parseFunction handles function declarations in the form:
 // retType name ( params ) { body }
 func (p *Parser) parseFunction() FunctionDecl {
-	retType := p.consume("ID").Value // Function return type.
-	name := p.consume("ID").Value    // Function name.
-	p.consume("LPAREN")              // Consume '('.
-	params := p.parseParams()        // Parse parameters.
-	p.consume("RPAREN")              // Consume ')'.
-	body := p.parseBlock()           // Parse function body enclosed in braces.
-	return FunctionDecl{RetType: retType, Name: name, Params: params, Body: body}
+	retType := p.parseType()      // Function return type.
+	line := p.current().Line      // Line of the name, after the return type.
+	name := p.consume("ID").Value // Function name.
+	p.consume("LPAREN")           // Consume '('.
+	params := p.parseParams()     // Parse parameters.
+	p.consume("RPAREN")           // Consume ')'.
+	p.funcName = name             // Track the enclosing function for __FUNC__.
+	body := p.parseBlock()        // Parse function body enclosed in braces.
+	p.funcName = ""
+	return FunctionDecl{RetType: retType, Name: name, Params: params, Body: body, Line: line}
 }
 
 // parseParams processes function parameters separated by commas.
+// A trailing comma before the closing parenthesis is allowed.
 func (p *Parser) parseParams() []Param {
 	var params []Param
-	// If the next token is RPAREN, there are no parameters.
-	if p.current().Type == "RPAREN" {
-		return params
-	}
-	// Loop until parameters are exhausted.
-	for {
-		paramType := p.consume("ID").Value // Parameter type.
+	// Loop until the closing parenthesis, which may follow a trailing comma.
+	for p.current().Type != "RPAREN" {
+		paramType := p.parseType()         // Parameter type.
+		line := p.current().Line           // Line of the parameter name.
 		paramName := p.consume("ID").Value // Parameter name.
-		params = append(params, Param{Type: paramType, Name: paramName})
-		if p.current().Type == "COMMA" {
-			p.consume("COMMA") // Consume comma between parameters.
-		} else {
+		params = append(params, Param{Type: paramType, Name: paramName, Line: line})
+		if p.current().Type != "COMMA" {
 			break
 		}
+		p.consume("COMMA") // Consume comma between parameters.
 	}
 	return params
 }
 
+// parseIf handles if (cond) { ... } [else if ... | else { ... }].
+func (p *Parser) parseIf() IfStmt {
+	line := p.consume("IF").Line
+	p.consume("LPAREN")
+	stmt := IfStmt{Cond: p.parseExpression(), Line: line}
+	p.consume("RPAREN")
+	stmt.Then = p.parseBlock()
+	if p.current().Type == "ELSE" {
+		p.consume("ELSE")
+		if p.current().Type == "IF" {
+			stmt.Else = []Node{p.parseIf()}
+		} else {
+			stmt.Else = p.parseBlock()
+			if stmt.Else == nil {
+				stmt.Else = []Node{} // Keep an empty else distinct from none.
+			}
+		}
+	}
+	return stmt
+}
+
+// parseWhile handles while (cond) { ... }.
+func (p *Parser) parseWhile() WhileStmt {
+	line := p.consume("WHILE").Line
+	p.consume("LPAREN")
+	stmt := WhileStmt{Cond: p.parseExpression(), Line: line}
+	p.consume("RPAREN")
+	stmt.Body = p.parseBlock()
+	return stmt
+}
+
+// parseSwitch handles switch (value) { case v: ... default: ... }. Each
+// clause runs until the next one, and may end with a fallthrough statement
+// to continue into the next clause instead of leaving the switch.
+func (p *Parser) parseSwitch() SwitchStmt {
+	line := p.consume("SWITCH").Line
+	p.consume("LPAREN")
+	stmt := SwitchStmt{Value: p.parseExpression(), Line: line}
+	p.consume("RPAREN")
+	p.consume("LBRACE")
+	hasDefault := false
+	seen := make(map[string]int) // Lines of the case values so far, by caseKey.
+	for p.current().Type != "RBRACE" {
+		tok := p.consume("CASE", "DEFAULT")
+		clause := CaseClause{Line: tok.Line}
+		if tok.Type == "CASE" {
+			clause.Value = p.parseExpression()
+			if key, ok := caseKey(clause.Value); ok {
+				if first, dup := seen[key]; dup {
+					panic(fmt.Sprintf("Duplicate case %s at line %d; the first is at line %d", key, tok.Line, first))
+				}
+				seen[key] = tok.Line
+			}
+		} else if hasDefault {
+			panic(fmt.Sprintf("Multiple defaults in switch at line %d", tok.Line))
+		} else {
+			hasDefault = true
+		}
+		p.consume("COLON")
+		for !p.atClauseEnd() {
+			if p.current().Type == "FALLTHROUGH" {
+				tok := p.consume("FALLTHROUGH")
+				p.consume("SEMICOLON")
+				if !p.atClauseEnd() {
+					panic(fmt.Sprintf("fallthrough must be the last statement of a case, at line %d", tok.Line))
+				}
+				if p.current().Type == "RBRACE" {
+					panic(fmt.Sprintf("Cannot fallthrough from the last case of a switch at line %d", tok.Line))
+				}
+				clause.Fallthrough = true
+				break
+			}
+			clause.Body = append(clause.Body, p.parseStatement())
+		}
+		stmt.Cases = append(stmt.Cases, clause)
+	}
+	p.consume("RBRACE")
+	return stmt
+}
+
+// caseKey returns the value of a case label, for spotting duplicates: the
+// number for an integer or character literal, so that 65, 0101 and 'A'
+// match as in C, or the name for a named constant. It reports false for
+// other expressions, whose values are not known until C compiles them.
+func caseKey(v Node) (string, bool) {
+	negate := false
+	if u, ok := v.(UnaryExpr); ok && (u.Op == "-" || u.Op == "+") {
+		v, negate = u.Operand, u.Op == "-"
+	}
+	var n int64
+	switch e := v.(type) {
+	case CharLiteral:
+		body := e.Value[1 : len(e.Value)-1]
+		// Go reads octal and hex escapes only with exactly three and two
+		// digits, where C allows fewer or more, so decode those here.
+		switch {
+		case strings.HasPrefix(body, `\x`):
+			code, _ := strconv.ParseUint(body[2:], 16, 8)
+			n = int64(code)
+		case len(body) > 1 && body[0] == '\\' && body[1] >= '0' && body[1] <= '7':
+			code, _ := strconv.ParseUint(body[1:], 8, 8)
+			n = int64(code)
+		case body == `\?`:
+			n = '?' // The one C escape Go does not have.
+		default:
+			r, _, tail, err := strconv.UnquoteChar(body, '\'')
+			if err != nil || tail != "" {
+				return e.Value, !negate // Not expected after checkEscapes.
+			}
+			n = int64(r)
+		}
+	case Expression:
+		if e.Value == "" || e.Value[0] < '0' || e.Value[0] > '9' {
+			return e.Value, !negate
+		}
+		// Octal and decimal literals both parse as C reads them.
+		var err error
+		if n, err = strconv.ParseInt(strings.TrimRight(e.Value, "uUlL"), 0, 64); err != nil {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	if negate {
+		n = -n
+	}
+	return strconv.FormatInt(n, 10), true
+}
+
+// atClauseEnd reports whether the current token ends a switch clause.
+func (p *Parser) atClauseEnd() bool {
+	switch p.current().Type {
+	case "CASE", "DEFAULT", "RBRACE":
+		return true
+	}
+	return false
+}
+
 // parseBlock processes a block of code enclosed in { }.
 func (p *Parser) parseBlock() []Node {
 	p.consume("LBRACE") // Consume '{'.
@@ -255,47 +1153,454 @@ func (p *Parser) parseBlock() []Node {
 
 // parseStatement distinguishes between variable declarations and expression statements.
 func (p *Parser) parseStatement() Node {
-	// Lookahead: if we see two IDs in a row, assume it's a variable declaration.
-	if p.current().Type == "ID" && p.tokens[p.pos+1].Type == "ID" {
-		varType := p.consume("ID").Value // Variable type.
+	switch p.current().Type {
+	case "IF":
+		return p.parseIf()
+	case "WHILE":
+		return p.parseWhile()
+	case "SWITCH":
+		return p.parseSwitch()
+	case "LBRACE":
+		return BlockStmt{Body: p.parseBlock()}
+	case "DELETE":
+		stmt := DeleteStmt{Line: p.consume("DELETE").Line}
+		stmt.Value = p.parseExpression()
+		p.consume("SEMICOLON")
+		return stmt
+	case "RETURN":
+		stmt := ReturnStmt{Line: p.consume("RETURN").Line}
+		if p.current().Type != "SEMICOLON" {
+			stmt.Value = p.parseExpression()
+		}
+		p.consume("SEMICOLON")
+		return stmt
+	}
+	// Lookahead: if we see a type followed by an ID, assume it's a variable
+	// declaration. A keyword in the name position is also treated as one, so
+	// that it is reported as a reserved word.
+	n := p.typeLength()
+	next := p.peek(n)
+	if n > 0 && (next.Type == "ID" || keywords[next.Value] == next.Type) {
+		varType := p.parseType()         // Variable type.
 		varName := p.consume("ID").Value // Variable name.
-		var def Expression               // Default value, if any.
+		var def Node                     // Default value, if any.
 		if p.current().Value == "=" {    // Check for assignment.
-			p.consume("OP")           // Consume '=' operator.
-			def = p.parseExpression() // Parse the default expression.
+			line := p.consume("OP").Line // Consume '=' operator.
+			def = p.parseExpression()    // Parse the default expression.
+			checkLiteralFits(varType, def, line)
 		}
 		p.consume("SEMICOLON") // End of variable declaration.
-		return VarDecl{VarType: varType, Name: varName, Default: def}
+		return VarDecl{VarType: varType, Name: varName, Default: def, Line: next.Line}
 	}
-	// Otherwise, parse an expression statement.
+	// Otherwise, parse an expression statement, which may turn out to be
+	// the target of an assignment.
+	tok := p.current()
 	expr := p.parseExpression()
+	if p.current().Type == "ASSIGN_OP" || p.current().Value == "=" {
+		if !isAssignable(expr) {
+			panic(fmt.Sprintf("Cannot assign to expression at line %d", tok.Line))
+		}
+		op := p.consume().Value
+		value := p.parseExpression()
+		p.consume("SEMICOLON")
+		return AssignStmt{Target: expr, Op: op, Value: value, Line: tok.Line}
+	}
 	p.consume("SEMICOLON")
-	return Statement{Expr: expr}
+	return Statement{Expr: expr, Line: tok.Line}
 }
 
-// parseExpression processes a simple literal expression.
-func (p *Parser) parseExpression() Expression {
-	tok := p.consume()
-	// Support literals: NUMBER, STRING, or identifiers.
-	if tok.Type == "NUMBER" || tok.Type == "STRING" || tok.Type == "ID" {
-		return Expression{Value: tok.Value}
+// intTypes gives the size and signedness of the integer types whose
+// literal initializers are range-checked.
+var intTypes = map[string]struct {
+	bits   int
+	signed bool
+}{
+	"char":     {8, true},
+	"byte":     {8, false},
+	"short":    {16, true},
+	"int":      {32, true},
+	"unsigned": {32, false},
+	"long":     {64, true},
+}
+
+// checkLiteralFits panics if expr is a numeric literal, possibly negated,
+// that cannot be represented in typ, rather than letting C silently truncate
+// it.
+func checkLiteralFits(typ string, expr Node, line int) {
+	sign := ""
+	if u, ok := expr.(UnaryExpr); ok && (u.Op == "-" || u.Op == "+") {
+		sign, expr = u.Op, u.Operand
+	}
+	lit, ok := expr.(Expression)
+	if !ok || lit.Value == "" || lit.Value[0] < '0' || lit.Value[0] > '9' {
+		return
+	}
+	lit.Value = sign + lit.Value
+	digits := strings.TrimRight(lit.Value, "fFuUlL")
+	if strings.ContainsAny(digits, ".eE") {
+		// Floating-point literals only need checking against float.
+		if typ == "float" {
+			if _, err := strconv.ParseFloat(digits, 32); err != nil {
+				panic(fmt.Sprintf("literal %s overflows float32 at line %d", lit.Value, line))
+			}
+		}
+		return
+	}
+	it, ok := intTypes[typ]
+	if !ok {
+		return
+	}
+	name := fmt.Sprintf("int%d", it.bits)
+	var err error
+	if it.signed {
+		_, err = strconv.ParseInt(digits, 10, it.bits)
+	} else {
+		name = "u" + name
+		_, err = strconv.ParseUint(digits, 10, it.bits)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("literal %s overflows %s at line %d", lit.Value, name, line))
 	}
-	panic(fmt.Sprintf("Unexpected token in expression: %v", tok))
 }
 
-// parseClass handles class declarations in the form:
-// class ClassName [: Parent] { members }
-func (p *Parser) parseClass() ClassDecl {
-	p.consume("ID")               // Consume the "class" keyword.
-	name := p.consume("ID").Value // Class name.
-	parent := ""
-	// Optional inheritance: if a colon is present, read the parent class.
-	if p.current().Type == "COLON" {
-		p.consume("COLON")
-		parent = p.consume("ID").Value
+// isAssignable reports whether expr may appear on the left of an assignment.
+func isAssignable(expr Node) bool {
+	switch e := expr.(type) {
+	case Expression:
+		return e.Value != "" && (e.Value[0] == '_' || unicode.IsLetter(rune(e.Value[0])))
+	case MemberAccess, ScopedName, Index:
+		return true
 	}
-	members := p.parseBlock() // Parse the class members enclosed in braces.
-	return ClassDecl{Name: name, Parent: parent, Members: members}
+	return false
+}
+
+// parseExpression parses a full expression. Each precedence level is
+// handled by its own function, from loosest to tightest binding.
+func (p *Parser) parseExpression() Node {
+	return p.parseLogicalOr()
+}
+
+// parseLogicalOr handles ||.
+func (p *Parser) parseLogicalOr() Node {
+	return p.parseBinaryLevel(p.parseLogicalAnd, "||")
+}
+
+// parseLogicalAnd handles &&.
+func (p *Parser) parseLogicalAnd() Node {
+	return p.parseBinaryLevel(p.parseBitOr, "&&")
+}
+
+// parseBitOr handles bitwise |.
+func (p *Parser) parseBitOr() Node {
+	return p.parseBinaryLevel(p.parseBitXor, "|")
+}
+
+// parseBitXor handles bitwise ^.
+func (p *Parser) parseBitXor() Node {
+	return p.parseBinaryLevel(p.parseBitAnd, "^")
+}
+
+// parseBitAnd handles bitwise &.
+func (p *Parser) parseBitAnd() Node {
+	return p.parseBinaryLevel(p.parseEquality, "&")
+}
+
+// parseEquality handles == and != comparisons.
+func (p *Parser) parseEquality() Node {
+	return p.parseBinaryLevel(p.parseRelational, "==", "!=")
+}
+
+// parseRelational handles <, >, <= and >= comparisons.
+func (p *Parser) parseRelational() Node {
+	return p.parseBinaryLevel(p.parseShift, "<", ">", "<=", ">=")
+}
+
+// parseShift handles << and >>.
+func (p *Parser) parseShift() Node {
+	return p.parseBinaryLevel(p.parseAdditive, "<<", ">>")
+}
+
+// parseAdditive handles + and -.
+func (p *Parser) parseAdditive() Node {
+	return p.parseBinaryLevel(p.parseMultiplicative, "+", "-")
+}
+
+// parseMultiplicative handles *, / and %.
+func (p *Parser) parseMultiplicative() Node {
+	return p.parseBinaryLevel(p.parseUnary, "*", "/", "%")
+}
+
+// parseUnary handles prefix operators such as !, ~ and ++.
+func (p *Parser) parseUnary() Node {
+	if p.atOperator("!", "~", "-", "+") {
+		op := p.consume().Value
+		return UnaryExpr{Op: op, Operand: p.parseUnary()}
+	}
+	if p.current().Type == "INCDEC" {
+		tok := p.consume()
+		operand := p.parseUnary()
+		if !isAssignable(operand) {
+			panic(fmt.Sprintf("Operand of %s must be assignable at line %d", tok.Value, tok.Line))
+		}
+		return UnaryExpr{Op: tok.Value, Operand: operand}
+	}
+	return p.parsePostfix()
+}
+
+// parseArgs parses the comma-separated arguments of a call, up to the
+// closing parenthesis. As with parameters, a trailing comma is allowed.
+func (p *Parser) parseArgs() []Node {
+	var args []Node
+	for p.current().Type != "RPAREN" {
+		args = append(args, p.parseExpression())
+		if p.current().Type != "COMMA" {
+			break
+		}
+		p.consume("COMMA")
+	}
+	return args
+}
+
+// parsePostfix handles member access, indexing, calls, and postfix ++ and --.
+func (p *Parser) parsePostfix() Node {
+	expr := p.parsePrimary()
+	for {
+		switch p.current().Type {
+		case "DOT":
+			p.consume("DOT")
+			expr = MemberAccess{Object: expr, Member: p.consume("ID").Value}
+		case "LBRACKET":
+			p.consume("LBRACKET")
+			index := p.parseExpression()
+			p.consume("RBRACKET")
+			expr = Index{Object: expr, Index: index}
+		case "LPAREN":
+			p.consume("LPAREN")
+			expr = CallExpr{Callee: expr, Args: p.parseArgs()}
+			p.consume("RPAREN")
+		case "INCDEC":
+			tok := p.consume()
+			if !isAssignable(expr) {
+				panic(fmt.Sprintf("Operand of %s must be assignable at line %d", tok.Value, tok.Line))
+			}
+			expr = PostfixExpr{Operand: expr, Op: tok.Value}
+		default:
+			return expr
+		}
+	}
+}
+
+// parseBinaryLevel parses a left-associative chain of the given operators,
+// using next to parse each operand.
+func (p *Parser) parseBinaryLevel(next func() Node, ops ...string) Node {
+	left := next()
+	for p.atOperator(ops...) {
+		op := p.consume().Value
+		left = BinaryExpr{Left: left, Op: op, Right: next()}
+	}
+	return left
+}
+
+// atOperator reports whether the current token is one of the given operators.
+func (p *Parser) atOperator(ops ...string) bool {
+	tok := p.current()
+	if tok.Type == "STRING" {
+		return false
+	}
+	for _, op := range ops {
+		if tok.Value == op {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrimary processes a simple literal expression.
+func (p *Parser) parsePrimary() Node {
+	tok := p.consume()
+	// Compile-time builtins are resolved here into literals.
+	if tok.Type == "ID" {
+		switch tok.Value {
+		case "__FILE__":
+			return Expression{Value: quoteC(p.file)}
+		case "__LINE__":
+			return Expression{Value: strconv.Itoa(tok.Line)}
+		case "__FUNC__":
+			if p.funcName == "" {
+				panic(fmt.Sprintf("__FUNC__ used outside of a function at line %d", tok.Line))
+			}
+			return Expression{Value: quoteC(p.funcName)}
+		case "nameof":
+			// nameof(name) yields the name itself as a string literal; for
+			// nameof(a.b) that is the member name, b.
+			p.consume("LPAREN")
+			name := p.consume("ID").Value
+			for p.current().Type == "DOT" {
+				p.consume("DOT")
+				name = p.consume("ID").Value
+			}
+			p.consume("RPAREN")
+			return Expression{Value: quoteC(name)}
+		}
+	}
+	if tok.Type == "LPAREN" {
+		// Grouping only shapes the tree; codegen adds back the parentheses
+		// C needs.
+		expr := p.parseExpression()
+		p.consume("RPAREN")
+		return expr
+	}
+	if tok.Type == "LBRACE" {
+		return p.parseObjectLiteral()
+	}
+	if tok.Type == "NEW" {
+		expr := NewExpr{Class: p.consume("ID").Value, Line: tok.Line}
+		p.consume("LPAREN")
+		expr.Args = p.parseArgs()
+		p.consume("RPAREN")
+		return expr
+	}
+	if tok.Type == "CHAR" {
+		return CharLiteral{Value: tok.Value}
+	}
+	if tok.Type == "INTERP_STRING" {
+		return p.parseInterpolated(tok)
+	}
+	if tok.Type == "ID" && p.current().Type == "DOUBLECOLON" {
+		name := ScopedName{Parts: []string{tok.Value}}
+		for p.current().Type == "DOUBLECOLON" {
+			p.consume("DOUBLECOLON")
+			name.Parts = append(name.Parts, p.consume("ID").Value)
+		}
+		return name
+	}
+	// Support literals: NUMBER, STRING, or identifiers.
+	if tok.Type == "NUMBER" || tok.Type == "STRING" || tok.Type == "ID" {
+		return Expression{Value: tok.Value}
+	}
+	panic(fmt.Sprintf("Unexpected token in expression: %v", tok))
+}
+
+// parseObjectLiteral parses the fields of an object literal after its
+// opening brace: { x: 1, y: 2 }. A trailing comma is allowed.
+func (p *Parser) parseObjectLiteral() ObjectLiteral {
+	var lit ObjectLiteral
+	seen := make(map[string]bool)
+	for p.current().Type != "RBRACE" {
+		name := p.consume("ID")
+		if seen[name.Value] {
+			panic(fmt.Sprintf("Field %s given twice in object literal at line %d", name.Value, name.Line))
+		}
+		seen[name.Value] = true
+		p.consume("COLON")
+		lit.Fields = append(lit.Fields, FieldInit{Name: name.Value, Value: p.parseExpression()})
+		if p.current().Type != "COMMA" {
+			break
+		}
+		p.consume("COMMA")
+	}
+	p.consume("RBRACE")
+	return lit
+}
+
+// parseInterpolated splits an interpolated string token into its literal
+// text and the expressions embedded in braces. Literal braces are written
+// as {{ and }}.
+func (p *Parser) parseInterpolated(tok Token) InterpolatedString {
+	body := tok.Value[2 : len(tok.Value)-1] // Strip the $" and ".
+	var node InterpolatedString
+	var text strings.Builder
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == '\\':
+			// Keep escape sequences intact for the C string.
+			text.WriteString(body[i : i+2])
+			i++
+		case (c == '{' || c == '}') && i+1 < len(body) && body[i+1] == c:
+			text.WriteByte(c)
+			i++
+		case c == '{':
+			end := strings.IndexByte(body[i:], '}')
+			if end < 0 {
+				panic(fmt.Sprintf("Unclosed { in interpolated string at line %d", tok.Line))
+			}
+			node.Text = append(node.Text, text.String())
+			text.Reset()
+			node.Exprs = append(node.Exprs, p.parseEmbedded(body[i+1:i+end], tok.Line))
+			i += end
+		case c == '}':
+			panic(fmt.Sprintf("Unmatched } in interpolated string at line %d (write }} for a literal brace)", tok.Line))
+		default:
+			text.WriteByte(c)
+		}
+	}
+	node.Text = append(node.Text, text.String())
+	return node
+}
+
+// parseEmbedded parses the source of an expression embedded in an
+// interpolated string on the given line.
+func (p *Parser) parseEmbedded(src string, line int) Node {
+	tokens, err := tokenize(src, LexOptions{})
+	if err != nil {
+		panic(fmt.Sprintf("%v in interpolated string at line %d", err, line))
+	}
+	for i := range tokens {
+		tokens[i].Line = line
+	}
+	sub := &Parser{tokens: tokens, file: p.file, funcName: p.funcName}
+	expr := sub.parseExpression()
+	sub.consume("EOF")
+	return expr
+}
+
+// quoteC returns s as a double-quoted C string literal.
+func quoteC(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// parseClass handles class declarations in the form:
+// class ClassName [: Parent] { members }
+func (p *Parser) parseClass() ClassDecl {
+	p.consume("CLASS")            // Consume the "class" keyword.
+	line := p.current().Line      // Line of the class name.
+	name := p.consume("ID").Value // Class name.
+	parent := ""
+	// Optional inheritance: if a colon is present, read the parent class.
+	if p.current().Type == "COLON" {
+		p.consume("COLON")
+		parent = p.consume("ID").Value
+	}
+	members := p.parseMembers() // Parse the class members enclosed in braces.
+	return ClassDecl{Name: name, Parent: parent, Members: members, Line: line}
+}
+
+// parseMembers processes the { } enclosed members of a class: methods, in the
+// form retType name ( params ) { body }, and field declarations, which may be
+// marked readonly.
+func (p *Parser) parseMembers() []Node {
+	p.consume("LBRACE") // Consume '{'.
+	var members []Node
+	for p.current().Type != "RBRACE" {
+		if p.current().Type == "READONLY" {
+			tok := p.consume("READONLY")
+			field, ok := p.parseStatement().(VarDecl)
+			if !ok {
+				panic(fmt.Sprintf("readonly must be followed by a field declaration at line %d", tok.Line))
+			}
+			field.Readonly = true
+			members = append(members, field)
+		} else if n := p.typeLength(); n > 0 && p.peek(n).Type == "ID" && p.peek(n+1).Type == "LPAREN" {
+			members = append(members, p.parseFunction())
+		} else {
+			members = append(members, p.parseStatement())
+		}
+	}
+	p.consume("RBRACE") // Consume '}'.
+	return members
 }
 
 /*
@@ -306,103 +1611,1299 @@ func (p *Parser) parseClass() ClassDecl {
 */
 
 type CodeGenerator struct {
-	ast    Program         // The AST produced by the parser.
-	code   strings.Builder // Used to build the output C code.
-	indent string          // Current indentation string.
+	ast     Program              // The AST produced by the parser.
+	classes map[string]ClassDecl // Class declarations, by name.
+	code    *strings.Builder     // Used to build the output C code.
+	indent  string               // Current indentation string.
+	vars    map[string]string    // Types of the variables in scope, by name.
+	globals map[string]string    // Types of the global variables, by name.
+	funcs   map[string]string    // Return types of the top-level functions, by name.
+	ret     string               // Return type of the function being generated.
+	split   bool                 // Generating one file per class (see generateSplit).
+	std     string               // C standard the output must build under, e.g. "c99".
+	used    map[string]bool      // Runtime helpers used by the current file.
+	sizes   []SizeEntry          // Amount of code generated per declaration.
+	spans   []SourceSpan         // Generated lines of each source line (see generate).
+	statics map[string]bool      // String variables last set to a literal, which delete must not free.
+}
+
+// SizeEntry records how much C code was generated for one declaration.
+type SizeEntry struct {
+	Kind  string // "class", "method" or "function".
+	Name  string // Declaration name; methods are written Class.method.
+	Lines int    // Number of generated lines.
+	Bytes int    // Number of generated bytes.
+}
+
+// recordSize adds the code written since offset start to the size entry
+// for the given declaration, creating the entry if needed.
+func (cg *CodeGenerator) recordSize(kind, name string, start int) {
+	out := cg.code.String()[start:]
+	for i := range cg.sizes {
+		if cg.sizes[i].Kind == kind && cg.sizes[i].Name == name {
+			cg.sizes[i].Lines += strings.Count(out, "\n")
+			cg.sizes[i].Bytes += len(out)
+			return
+		}
+	}
+	cg.sizes = append(cg.sizes, SizeEntry{Kind: kind, Name: name, Lines: strings.Count(out, "\n"), Bytes: len(out)})
+}
+
+// SourceSpan records the C lines generated for a statement or declaration.
+// Spans nest as the statements do.
+type SourceSpan struct {
+	Line  int // Line of the X# source.
+	First int // First generated line, counting from 0.
+	Last  int // Last generated line.
+}
+
+// recordSpan adds a span for the code written since offset start, which
+// came from the given source line, leaving out trailing blank lines.
+// Generated code (line 0) has none.
+func (cg *CodeGenerator) recordSpan(line, start int) {
+	code := cg.code.String()
+	first, last := strings.Count(code[:start], "\n"), strings.Count(strings.TrimRight(code, "\n"), "\n")
+	if line > 0 && last >= first {
+		cg.spans = append(cg.spans, SourceSpan{Line: line, First: first, Last: last})
+	}
+}
+
+// shiftSpans moves the spans recorded from index from on by n lines, for
+// when their code is placed after n other lines.
+func (cg *CodeGenerator) shiftSpans(from, n int) {
+	for i := range cg.spans[from:] {
+		cg.spans[from+i].First += n
+		cg.spans[from+i].Last += n
+	}
 }
 
 // NewCodeGenerator returns a new CodeGenerator.
 func NewCodeGenerator(ast Program) *CodeGenerator {
-	return &CodeGenerator{ast: ast, indent: ""}
+	classes := make(map[string]ClassDecl)
+	globals := make(map[string]string)
+	funcs := make(map[string]string)
+	for _, decl := range ast.Declarations {
+		switch d := decl.(type) {
+		case ClassDecl:
+			classes[d.Name] = d
+		case VarDecl:
+			globals[d.Name] = d.VarType
+		case FunctionDecl:
+			funcs[d.Name] = d.RetType
+		}
+	}
+	return &CodeGenerator{ast: ast, classes: classes, globals: globals, funcs: funcs, code: &strings.Builder{}, indent: "", std: "c99", used: make(map[string]bool)}
+}
+
+// runtimeHelpers holds C support functions that generated code may call.
+// Each is emitted, as a static function, only into files that use it.
+var runtimeHelpers = map[string]string{
+	// xs_format formats into a freshly allocated string, which the caller owns.
+	"xs_format": `#include <stdarg.h>
+
+static char* xs_format(const char* fmt, ...) {
+    va_list args;
+    va_start(args, fmt);
+    int n = vsnprintf(NULL, 0, fmt, args);
+    va_end(args);
+    char* buf = malloc(n + 1);
+    va_start(args, fmt);
+    vsnprintf(buf, n + 1, fmt, args);
+    va_end(args);
+    return buf;
+}
+`,
 }
 
-// generate starts the code generation process.
+// generate starts the code generation process. Afterwards cg.spans maps the
+// source lines to the lines of the result.
 func (cg *CodeGenerator) generate() string {
 	cg.emitIncludes() // Emit standard C includes.
 	// Process each top-level declaration.
+	from, offset := len(cg.spans), strings.Count(cg.code.String(), "\n")
+	defer cg.shiftSpans(from, offset)
+	cg.code.WriteString(cg.withRuntime(func() {
+		for _, decl := range cg.ast.Declarations {
+			switch d := decl.(type) {
+			case FunctionDecl:
+				cg.emitFunction(d)
+			case ClassDecl:
+				cg.emitClass(d)
+			case VarDecl:
+				cg.emitGlobal(d)
+			}
+		}
+	}))
+	return cg.code.String()
+}
+
+// withRuntime runs emit and returns its output, preceded by the runtime
+// helpers that output calls.
+func (cg *CodeGenerator) withRuntime(emit func()) string {
+	cg.used = make(map[string]bool)
+	from := len(cg.spans)
+	body := cg.capture(emit)
+	var names []string
+	for name := range cg.used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out strings.Builder
+	for _, name := range names {
+		out.WriteString(runtimeHelpers[name] + "\n")
+	}
+	cg.shiftSpans(from, strings.Count(out.String(), "\n"))
+	return out.String() + body
+}
+
+// generateSplit generates a header and source file for each class, plus a
+// main source file holding the free functions. A shared header, named after
+// the main file, declares every class and public function and global, so
+// that each source file can use them whatever order they are defined in;
+// the source files then include every class header. The result maps file
+// names, relative to the output directory, to their contents.
+func (cg *CodeGenerator) generateSplit(mainFile string) map[string]string {
+	cg.split = true
+	shared := strings.TrimSuffix(mainFile, filepath.Ext(mainFile)) + ".h"
+	classes := make(map[string]bool)
+	for _, decl := range cg.ast.Declarations {
+		if cls, ok := decl.(ClassDecl); ok {
+			if cls.Name+".h" == shared {
+				panic(fmt.Sprintf("class %s's header would overwrite the shared header %s; rename the class or the output file", cls.Name, shared))
+			}
+			classes[cls.Name] = true
+		}
+	}
+	files := map[string]string{shared: cg.capture(func() { cg.emitSharedHeader(shared) })}
+	// includeAll writes the includes of the shared header and every class
+	// header, which together give a source file all the definitions.
+	includeAll := func() {
+		cg.code.WriteString(fmt.Sprintf("#include \"%s\"\n", shared))
+		for _, decl := range cg.ast.Declarations {
+			if cls, ok := decl.(ClassDecl); ok {
+				cg.code.WriteString(fmt.Sprintf("#include \"%s.h\"\n", cls.Name))
+			}
+		}
+		cg.code.WriteString("\n")
+	}
+	for _, decl := range cg.ast.Declarations {
+		cls, ok := decl.(ClassDecl)
+		if !ok {
+			continue
+		}
+		files[cls.Name+".h"] = cg.capture(func() { cg.emitClassHeader(cls, classes, shared) })
+		files[cls.Name+".c"] = cg.capture(func() {
+			includeAll()
+			cg.code.WriteString(cg.withRuntime(func() { cg.emitClassMethods(cls) }))
+		})
+	}
+	files[mainFile] = cg.capture(func() {
+		includeAll()
+		cg.code.WriteString(cg.withRuntime(func() {
+			for _, decl := range cg.ast.Declarations {
+				switch d := decl.(type) {
+				case FunctionDecl:
+					cg.emitFunction(d)
+				case VarDecl:
+					cg.emitGlobal(d)
+				}
+			}
+		}))
+	})
+	return files
+}
+
+// emitSharedHeader generates the header shared by the split output files:
+// the C includes, a forward typedef of each class's struct, and prototypes
+// of the functions and globals. Private ones are declared too, since the
+// methods of the module's classes, in other files, may use them.
+func (cg *CodeGenerator) emitSharedHeader(name string) {
+	guard := strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+	cg.code.WriteString(fmt.Sprintf("#ifndef %s\n#define %s\n\n", guard, guard))
+	cg.emitIncludes()
+	var decls []string
+	for _, decl := range cg.ast.Declarations {
+		if cls, ok := decl.(ClassDecl); ok {
+			decls = append(decls, fmt.Sprintf("typedef struct %s %s;", cls.Name, cls.Name))
+		}
+	}
+	if len(decls) > 0 {
+		cg.code.WriteString(strings.Join(decls, "\n") + "\n\n")
+	}
+	decls = nil
 	for _, decl := range cg.ast.Declarations {
 		switch d := decl.(type) {
 		case FunctionDecl:
-			cg.emitFunction(d)
-		case ClassDecl:
-			cg.emitClass(d)
+			decls = append(decls, functionSignature(d)+";")
+		case VarDecl:
+			decls = append(decls, fmt.Sprintf("extern %s %s;", d.VarType, d.Name))
 		}
 	}
-	return cg.code.String()
+	if len(decls) > 0 {
+		cg.code.WriteString(strings.Join(decls, "\n") + "\n\n")
+	}
+	cg.code.WriteString(fmt.Sprintf("#endif /* %s */\n", guard))
 }
 
+// capture runs emit against a fresh output buffer and returns what it wrote.
+func (cg *CodeGenerator) capture(emit func()) string {
+	saved := cg.code
+	cg.code = &strings.Builder{}
+	emit()
+	out := cg.code.String()
+	cg.code = saved
+	return out
+}
+
+// cStandards are the C standards the generated code can target.
+var cStandards = map[string]bool{"c89": true, "c99": true, "c11": true}
+
 // emitIncludes writes the necessary C library includes.
 func (cg *CodeGenerator) emitIncludes() {
-	cg.code.WriteString("#include <stdio.h>\n#include <stdlib.h>\n#include <string.h>\n\n")
+	cg.code.WriteString("#include <stdio.h>\n#include <stdlib.h>\n#include <string.h>\n")
+	if cg.std == "c89" {
+		// C89 has no stdbool.h; every header repeats this, so it is guarded.
+		cg.code.WriteString("\n#ifndef XS_BOOL\n#define XS_BOOL\ntypedef int bool;\n#define true 1\n#define false 0\n#endif\n")
+	} else {
+		cg.code.WriteString("#include <stdbool.h>\n")
+	}
+	// The string type is a plain C string; C before C11 does not allow a
+	// typedef to be repeated, so it is guarded too.
+	cg.code.WriteString("\n#ifndef XS_STRING\n#define XS_STRING\ntypedef char* string;\n#endif\n\n")
+}
+
+// resetStatics starts tracking which string variables hold literals afresh,
+// for a new function, from the globals' initial values.
+func (cg *CodeGenerator) resetStatics() {
+	cg.statics = make(map[string]bool)
+	for _, decl := range cg.ast.Declarations {
+		if v, ok := decl.(VarDecl); ok && v.VarType == "string" {
+			cg.statics[v.Name] = isStringLiteral(v.Default)
+		}
+	}
+}
+
+// isStringLiteral reports whether expr is a string literal, which lives in
+// static storage rather than on the heap.
+func isStringLiteral(expr Node) bool {
+	lit, ok := expr.(Expression)
+	return ok && strings.HasPrefix(lit.Value, `"`)
 }
 
 // emitFunction generates C code for a function declaration.
 func (cg *CodeGenerator) emitFunction(fn FunctionDecl) {
+	defer cg.recordSize("function", fn.Name, cg.code.Len())
+	defer cg.recordSpan(fn.Line, cg.code.Len())
 	// Build parameter list as "type name" strings.
+	cg.vars = make(map[string]string)
+	cg.ret = fn.RetType
+	cg.resetStatics()
+	for _, param := range fn.Params {
+		cg.vars[param.Name] = param.Type
+	}
+	// Emit function signature; private functions get static linkage, unless
+	// split output needs them visible to the class files.
+	cg.code.WriteString(linkage(fn.Private && !cg.split) + functionSignature(fn) + " {\n")
+	cg.indent = "    " // Increase indentation for the function body.
+	body := fn.Body
+	if fn.Name == "main" {
+		body = append(cg.globalInits(), body...)
+	}
+	cg.emitBody(body)
+	cg.code.WriteString("}\n\n") // Close the function.
+}
+
+// functionSignature returns the C signature of a top-level function.
+func functionSignature(fn FunctionDecl) string {
 	var params []string
 	for _, param := range fn.Params {
 		params = append(params, fmt.Sprintf("%s %s", param.Type, param.Name))
 	}
-	// Emit function signature.
-	cg.code.WriteString(fmt.Sprintf("%s %s(%s) {\n", fn.RetType, fn.Name, strings.Join(params, ", ")))
-	cg.indent = "    " // Increase indentation for the function body.
-	// Emit each statement in the function body.
-	for _, stmt := range fn.Body {
+	return fmt.Sprintf("%s %s(%s)", fn.RetType, fn.Name, strings.Join(params, ", "))
+}
+
+// emitGlobal generates C code for a global variable declaration.
+func (cg *CodeGenerator) emitGlobal(v VarDecl) {
+	defer cg.recordSpan(v.Line, cg.code.Len())
+	line := fmt.Sprintf("%s%s %s", linkage(v.Private && !cg.split), v.VarType, v.Name)
+	if v.Default != nil {
+		line += " = " + cg.emitExpression(typedLiteral(v.VarType, v.Default))
+	}
+	cg.code.WriteString(line + ";\n\n")
+}
+
+// linkage returns the storage class giving a module-level declaration the
+// right C linkage: private declarations are static to their file.
+func linkage(private bool) string {
+	if private {
+		return "static "
+	}
+	return ""
+}
+
+// emitBody generates C code for the statements of a function body.
+func (cg *CodeGenerator) emitBody(body []Node) {
+	body = cg.withInitCalls(body)
+	if cg.std == "c89" {
+		body = hoistDeclarations(body)
+	}
+	for _, stmt := range body {
 		cg.emitStatement(stmt)
 	}
-	cg.code.WriteString("}\n\n") // Close the function.
+}
+
+// withInitCalls follows each declaration of an object whose class needs
+// initializing (see needsInit) with a call of the class's init function.
+func (cg *CodeGenerator) withInitCalls(body []Node) []Node {
+	var out []Node
+	for _, stmt := range body {
+		out = append(out, stmt)
+		if v, ok := stmt.(VarDecl); ok && v.Default == nil && cg.needsInit(v.VarType) {
+			out = append(out, initCall(v))
+		}
+	}
+	return out
+}
+
+// globalInits returns the init calls for the global objects that need them,
+// which C cannot make in a static initializer; main runs them first.
+func (cg *CodeGenerator) globalInits() []Node {
+	var calls []Node
+	for _, decl := range cg.ast.Declarations {
+		if v, ok := decl.(VarDecl); ok && v.Default == nil && cg.needsInit(v.VarType) {
+			calls = append(calls, initCall(v))
+		}
+	}
+	return calls
+}
+
+// initCall returns the statement calling the init function for the object
+// declared by v.
+func initCall(v VarDecl) Node {
+	return Statement{Expr: CallExpr{
+		Callee: Expression{Value: v.VarType + "_init"},
+		Args:   []Node{UnaryExpr{Op: "&", Operand: Expression{Value: v.Name}}},
+	}}
+}
+
+// needsInit reports whether objects of the named class need their init
+// function called: whether the class or an ancestor gives a field a
+// default, or has a field whose class needs initializing in turn.
+func (cg *CodeGenerator) needsInit(class string) bool {
+	seen := make(map[string]bool)
+	var needs func(class string) bool
+	needs = func(class string) bool {
+		if seen[class] {
+			return false
+		}
+		seen[class] = true
+		for _, v := range cg.fields(class) {
+			if v.Default != nil || needs(v.VarType) {
+				return true
+			}
+		}
+		return false
+	}
+	return needs(class)
+}
+
+// initSignature returns the C signature of the function that applies the
+// field defaults of cls. It returns its argument, so that new can wrap the
+// allocation in the call.
+func initSignature(cls ClassDecl) string {
+	return fmt.Sprintf("%s* %s_init(%s* this)", cls.Name, cls.Name, cls.Name)
+}
+
+// hoistDeclarations rewrites a body for C89, which only allows declarations
+// at the start of a block. Declarations after the first other statement move
+// up, uninitialized, and their initial value becomes an assignment where
+// they were. A declaration whose name the statements before it already use,
+// meaning some outer variable, cannot move above them; it and the rest of
+// the body go in a nested block instead.
+func hoistDeclarations(body []Node) []Node {
+	var decls, rest []Node
+	for i, stmt := range body {
+		v, ok := stmt.(VarDecl)
+		switch {
+		case !ok:
+			rest = append(rest, stmt)
+		case len(rest) == 0:
+			decls = append(decls, v) // Already at the start.
+		case mentions(rest, v.Name):
+			rest = append(rest, BlockStmt{Body: body[i:]})
+			return append(decls, rest...)
+		default:
+			decls = append(decls, VarDecl{VarType: v.VarType, Name: v.Name})
+			if v.Default != nil {
+				rest = append(rest, AssignStmt{Target: Expression{Value: v.Name}, Op: "=", Value: typedLiteral(v.VarType, v.Default), Line: v.Line})
+			}
+		}
+	}
+	return append(decls, rest...)
+}
+
+// mentions reports whether any of nodes refers to the variable name. It
+// errs on the side of yes: a nested declaration of the name counts too.
+func mentions(nodes []Node, name string) bool {
+	for _, n := range nodes {
+		var found bool
+		switch n := n.(type) {
+		case Expression:
+			found = n.Value == name
+		case VarDecl:
+			found = n.Name == name || mentions([]Node{n.Default}, name)
+		case AssignStmt:
+			found = mentions([]Node{n.Target, n.Value}, name)
+		case Statement:
+			found = mentions([]Node{n.Expr}, name)
+		case ReturnStmt:
+			found = mentions([]Node{n.Value}, name)
+		case DeleteStmt:
+			found = mentions([]Node{n.Value}, name)
+		case BlockStmt:
+			found = mentions(n.Body, name)
+		case IfStmt:
+			found = mentions([]Node{n.Cond}, name) || mentions(n.Then, name) || mentions(n.Else, name)
+		case WhileStmt:
+			found = mentions([]Node{n.Cond}, name) || mentions(n.Body, name)
+		case SwitchStmt:
+			found = mentions([]Node{n.Value}, name)
+			for _, clause := range n.Cases {
+				found = found || mentions([]Node{clause.Value}, name) || mentions(clause.Body, name)
+			}
+		case BinaryExpr:
+			found = mentions([]Node{n.Left, n.Right}, name)
+		case UnaryExpr:
+			found = mentions([]Node{n.Operand}, name)
+		case PostfixExpr:
+			found = mentions([]Node{n.Operand}, name)
+		case MemberAccess:
+			found = mentions([]Node{n.Object}, name)
+		case Index:
+			found = mentions([]Node{n.Object, n.Index}, name)
+		case CallExpr:
+			found = mentions(append([]Node{n.Callee}, n.Args...), name)
+		case NewExpr:
+			found = mentions(n.Args, name)
+		case InterpolatedString:
+			found = mentions(n.Exprs, name)
+		case ObjectLiteral:
+			for _, field := range n.Fields {
+				found = found || mentions([]Node{field.Value}, name)
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// stmtLine returns the source line a statement starts on, or 0 if unknown.
+func stmtLine(stmt Node) int {
+	switch s := stmt.(type) {
+	case VarDecl:
+		return s.Line
+	case AssignStmt:
+		return s.Line
+	case IfStmt:
+		return s.Line
+	case WhileStmt:
+		return s.Line
+	case SwitchStmt:
+		return s.Line
+	case ReturnStmt:
+		return s.Line
+	case DeleteStmt:
+		return s.Line
+	case Statement:
+		return s.Line
+	}
+	return 0
 }
 
 // emitStatement generates C code for a single statement.
 func (cg *CodeGenerator) emitStatement(stmt Node) {
+	defer cg.recordSpan(stmtLine(stmt), cg.code.Len())
 	switch s := stmt.(type) {
 	case VarDecl:
 		// Variable declaration: type name [= default];
+		cg.vars[s.Name] = s.VarType
+		cg.statics[s.Name] = s.VarType == "string" && isStringLiteral(s.Default)
 		line := fmt.Sprintf("%s%s %s", cg.indent, s.VarType, s.Name)
-		if s.Default.Value != "" {
-			// Check if the default is a number (no quotes needed) or string.
-			if _, err := strconv.ParseFloat(s.Default.Value, 64); err == nil {
-				line += " = " + s.Default.Value
-			} else {
-				line += " = " + s.Default.Value
-			}
+		if s.Default != nil {
+			line += " = " + cg.emitExpression(typedLiteral(s.VarType, s.Default))
 		}
 		line += ";\n"
 		cg.code.WriteString(line)
+	case AssignStmt:
+		// Plain and compound assignments map directly onto C.
+		cg.checkWritable(s.Target)
+		if target, ok := s.Target.(Expression); ok && s.Op == "=" {
+			cg.statics[target.Value] = isStringLiteral(s.Value)
+		}
+		value := cg.emitValue(cg.exprType(s.Target), s.Value)
+		cg.code.WriteString(fmt.Sprintf("%s%s %s %s;\n", cg.indent, cg.emitExpression(s.Target), s.Op, value))
+	case IfStmt:
+		cg.code.WriteString(cg.indent)
+		cg.emitIf(s)
+		cg.code.WriteString("\n")
+	case WhileStmt:
+		cg.code.WriteString(fmt.Sprintf("%swhile (%s) {\n", cg.indent, cg.emitExpression(s.Cond)))
+		cg.emitBlock(s.Body)
+		cg.code.WriteString(cg.indent + "}\n")
+	case SwitchStmt:
+		cg.code.WriteString(fmt.Sprintf("%sswitch (%s) {\n", cg.indent, cg.emitExpression(s.Value)))
+		for _, clause := range s.Cases {
+			cg.emitCase(clause)
+		}
+		cg.code.WriteString(cg.indent + "}\n")
+	case BlockStmt:
+		cg.code.WriteString(cg.indent + "{\n")
+		cg.emitBlock(s.Body)
+		cg.code.WriteString(cg.indent + "}\n")
+	case DeleteStmt:
+		// Classes have no destructors yet, so deleting is just freeing. A
+		// string may be freed only if it was allocated, e.g. by
+		// interpolation, rather than being a literal.
+		typ := cg.exprType(s.Value)
+		name, isVar := s.Value.(Expression)
+		switch {
+		case isStringLiteral(s.Value) || (isVar && typ == "string" && cg.statics[name.Value]):
+			panic(fmt.Sprintf("cannot delete a string literal, which is not on the heap, at line %d", s.Line))
+		case typ != "" && typ != "string" && !strings.HasSuffix(typ, "*"):
+			panic(fmt.Sprintf("cannot delete a value of type %s, which is not a pointer, at line %d", typ, s.Line))
+		}
+		cg.code.WriteString(fmt.Sprintf("%sfree(%s);\n", cg.indent, cg.emitExpression(s.Value)))
+	case ReturnStmt:
+		switch {
+		case s.Value == nil && cg.ret != "void":
+			panic(fmt.Sprintf("missing return value of type %s at line %d", cg.ret, s.Line))
+		case s.Value == nil:
+			cg.code.WriteString(cg.indent + "return;\n")
+		case cg.ret == "void":
+			panic(fmt.Sprintf("void function returns a value at line %d", s.Line))
+		default:
+			cg.code.WriteString(fmt.Sprintf("%sreturn %s;\n", cg.indent, cg.emitValue(cg.ret, s.Value)))
+		}
 	case Statement:
 		// Expression statement ends with a semicolon.
-		cg.code.WriteString(fmt.Sprintf("%s%s;\n", cg.indent, s.Expr.Value))
+		cg.code.WriteString(fmt.Sprintf("%s%s;\n", cg.indent, cg.emitExpression(s.Expr)))
 	default:
 		// Placeholder for any unhandled statements.
-		cg.code.WriteString(fmt.Sprintf("%s// Unknown statement\n", cg.indent))
+		cg.code.WriteString(fmt.Sprintf("%s/* Unknown statement */\n", cg.indent))
+	}
+}
+
+// emitIf writes an if statement, starting at the current position so that
+// an else-if continues the line of the closing brace before it.
+func (cg *CodeGenerator) emitIf(s IfStmt) {
+	cg.code.WriteString(fmt.Sprintf("if (%s) {\n", cg.emitExpression(s.Cond)))
+	cg.emitBlock(s.Then)
+	cg.code.WriteString(cg.indent + "}")
+	if len(s.Else) == 1 {
+		if elseIf, ok := s.Else[0].(IfStmt); ok {
+			cg.code.WriteString(" else ")
+			cg.emitIf(elseIf)
+			return
+		}
+	}
+	if s.Else != nil {
+		cg.code.WriteString(" else {\n")
+		cg.emitBlock(s.Else)
+		cg.code.WriteString(cg.indent + "}")
+	}
+}
+
+// emitCase writes one clause of a switch, one level in from the switch, with
+// the break that ends it unless it falls through. A clause that declares
+// variables gets braces, since C does not allow a declaration right after a
+// label.
+func (cg *CodeGenerator) emitCase(clause CaseClause) {
+	saved := cg.indent
+	defer func() { cg.indent = saved }()
+	cg.indent += "    "
+	label := "default:"
+	if clause.Value != nil {
+		label = fmt.Sprintf("case %s:", cg.emitExpression(clause.Value))
+	}
+	braces := false
+	for _, stmt := range clause.Body {
+		if _, ok := stmt.(VarDecl); ok {
+			braces = true
+		}
+	}
+	if braces {
+		label += " {"
+	}
+	cg.code.WriteString(cg.indent + label + "\n")
+	cg.emitBlock(clause.Body)
+	if !clause.Fallthrough {
+		cg.code.WriteString(cg.indent + "    break;\n")
+	}
+	if braces {
+		cg.code.WriteString(cg.indent + "}\n")
+	}
+}
+
+// emitBlock writes the statements of a nested block one level further in.
+// Variables declared in the block go out of scope at its end.
+func (cg *CodeGenerator) emitBlock(body []Node) {
+	saved, vars := cg.indent, cg.vars
+	cg.indent += "    "
+	cg.vars = make(map[string]string, len(vars))
+	for name, typ := range vars {
+		cg.vars[name] = typ
+	}
+	cg.emitBody(body)
+	cg.indent, cg.vars = saved, vars
+}
+
+// emitValue returns the C for expr used as a value of type typ anywhere but
+// a declaration's initializer, where an object literal needs to be a C99
+// compound literal.
+func (cg *CodeGenerator) emitValue(typ string, expr Node) string {
+	expr = typedLiteral(typ, expr)
+	code := cg.emitExpression(expr)
+	if _, ok := expr.(ObjectLiteral); ok {
+		code = fmt.Sprintf("(%s)%s", typ, code)
 	}
+	return code
+}
+
+// typedLiteral gives an unsuffixed numeric literal the type of the context it
+// is used in, the way Go treats untyped constants: 1 initializing a float
+// becomes 1.0f, and 1 or 2.5 initializing a double becomes 1.0 or 2.5.
+// Anything else is returned unchanged.
+func typedLiteral(typ string, expr Node) Node {
+	if lit, ok := expr.(ObjectLiteral); ok {
+		lit.Class = typ
+		return lit
+	}
+	if u, ok := expr.(UnaryExpr); ok && (u.Op == "-" || u.Op == "+") {
+		u.Operand = typedLiteral(typ, u.Operand)
+		return u
+	}
+	lit, ok := expr.(Expression)
+	if !ok || lit.Value == "" || lit.Value[0] < '0' || lit.Value[0] > '9' {
+		return expr
+	}
+	if strings.ContainsAny(lit.Value, "fFuUlL") {
+		// An explicit suffix already fixes the literal's type.
+		return expr
+	}
+	isFloat := strings.ContainsAny(lit.Value, ".eE")
+	switch typ {
+	case "float":
+		if !isFloat {
+			lit.Value += ".0"
+		}
+		lit.Value += "f"
+	case "double":
+		if !isFloat {
+			lit.Value += ".0"
+		}
+	}
+	return lit
+}
+
+// binaryPrecedence gives the C binding strength of each binary operator;
+// higher binds tighter.
+var binaryPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"|":  3,
+	"^":  4,
+	"&":  5,
+	"==": 6, "!=": 6,
+	"<": 7, ">": 7, "<=": 7, ">=": 7,
+	"<<": 8, ">>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+}
+
+// emitExpression returns the C source for an expression.
+func (cg *CodeGenerator) emitExpression(expr Node) string {
+	switch e := expr.(type) {
+	case Expression:
+		if strings.HasPrefix(e.Value, `"`) {
+			return encodeUnicodeEscapes(e.Value)
+		}
+		return e.Value
+	case CharLiteral:
+		return encodeUnicodeEscapes(e.Value)
+	case BinaryExpr:
+		left := cg.emitOperand(e.Left, e.Op, false)
+		right := cg.emitOperand(e.Right, e.Op, true)
+		return fmt.Sprintf("%s %s %s", left, e.Op, right)
+	case UnaryExpr:
+		if e.Op == "++" || e.Op == "--" {
+			cg.checkWritable(e.Operand)
+		}
+		operand := cg.emitExpression(e.Operand)
+		if _, ok := e.Operand.(BinaryExpr); ok {
+			operand = "(" + operand + ")"
+		}
+		// Keep - -x and + ++x from running together into -- and +++.
+		if strings.HasSuffix(e.Op, operand[:1]) && (operand[0] == '-' || operand[0] == '+') {
+			return e.Op + " " + operand
+		}
+		return e.Op + operand
+	case PostfixExpr:
+		cg.checkWritable(e.Operand)
+		return cg.emitPrimary(e.Operand) + e.Op
+	case InterpolatedString:
+		return cg.emitInterpolated(e)
+	case MemberAccess:
+		// Class instances behind a pointer, such as this, use ->.
+		sep := "."
+		if strings.HasSuffix(cg.exprType(e.Object), "*") {
+			sep = "->"
+		}
+		return cg.emitPrimary(e.Object) + sep + e.Member
+	case Index:
+		return fmt.Sprintf("%s[%s]", cg.emitPrimary(e.Object), cg.emitExpression(e.Index))
+	case ScopedName:
+		// C has one namespace, so math::sqrt becomes math_sqrt.
+		return strings.Join(e.Parts, "_")
+	case CallExpr:
+		return cg.emitCall(e)
+	case ObjectLiteral:
+		return cg.emitObjectLiteral(e)
+	case NewExpr:
+		return cg.emitNew(e)
+	}
+	panic(fmt.Sprintf("cannot generate code for expression %#v", expr))
+}
+
+// emitObjectLiteral generates a C designated initializer for an object
+// literal. Fields left out get their defaults, if they have any, and zero
+// otherwise.
+func (cg *CodeGenerator) emitObjectLiteral(lit ObjectLiteral) string {
+	cls, ok := cg.classes[lit.Class]
+	if !ok {
+		panic(fmt.Sprintf("object literal used as %q, which is not a class", lit.Class))
+	}
+	if cg.std == "c89" {
+		panic("object literals need designated initializers, which C89 lacks; use --cstd=c99 or later")
+	}
+	given := make(map[string]Node)
+	for _, f := range lit.Fields {
+		given[f.Name] = f.Value
+	}
+	var inits []string
+	for _, v := range cg.fields(cls.Name) {
+		value, ok := given[v.Name]
+		if ok {
+			delete(given, v.Name)
+		} else {
+			value = v.Default
+		}
+		if value == nil && cg.needsInit(v.VarType) {
+			value = ObjectLiteral{} // Nested objects get their defaults too.
+		}
+		if value != nil {
+			inits = append(inits, fmt.Sprintf(".%s = %s", v.Name, cg.emitExpression(typedLiteral(v.VarType, value))))
+		}
+	}
+	for _, f := range lit.Fields {
+		if _, unknown := given[f.Name]; unknown {
+			panic(fmt.Sprintf("class %s has no field %s", cls.Name, f.Name))
+		}
+	}
+	if len(inits) == 0 {
+		return "{ 0 }" // C before C23 does not allow empty braces.
+	}
+	return "{ " + strings.Join(inits, ", ") + " }"
+}
+
+// emitNew allocates an object with malloc and applies its field defaults,
+// if it has any.
+func (cg *CodeGenerator) emitNew(e NewExpr) string {
+	cls, ok := cg.classes[e.Class]
+	if !ok {
+		panic(fmt.Sprintf("new of unknown class %s at line %d", e.Class, e.Line))
+	}
+	if len(e.Args) > 0 {
+		panic(fmt.Sprintf("classes have no constructors, so new %s takes no arguments, at line %d", e.Class, e.Line))
+	}
+	alloc := fmt.Sprintf("malloc(sizeof(%s))", cls.Name)
+	if cg.needsInit(cls.Name) {
+		return fmt.Sprintf("%s_init(%s)", cls.Name, alloc)
+	}
+	return alloc
+}
+
+// emitCall generates C code for a call. A method call becomes a call of the
+// method's function with a pointer to the object first, as in
+// Point_move(&p, 1, 2).
+func (cg *CodeGenerator) emitCall(call CallExpr) string {
+	var args []string
+	var params []Param // The callee's parameters, if known.
+	callee := ""
+	if m, ok := call.Callee.(MemberAccess); ok {
+		typ := cg.exprType(m.Object)
+		class := strings.TrimSuffix(typ, "*")
+		cls, fn, ok := cg.findMethod(class, m.Member)
+		params = fn.Params
+		if _, known := cg.classes[class]; known && !ok {
+			panic(fmt.Sprintf("class %s has no method %s", class, m.Member))
+		}
+		if ok {
+			this := cg.emitExpression(m.Object)
+			if !strings.HasSuffix(typ, "*") {
+				this = "&" + cg.emitPrimary(m.Object)
+			}
+			if cls.Name != class {
+				// Inherited methods take a pointer to the class defining them.
+				this = fmt.Sprintf("(%s*)%s", cls.Name, this)
+			}
+			callee = cls.Name + "_" + m.Member
+			args = append(args, this)
+		}
+	}
+	if callee == "" {
+		callee = cg.emitPrimary(call.Callee)
+		if name, ok := call.Callee.(Expression); ok {
+			params = cg.findFunction(name.Value).Params
+		}
+	}
+	for i, arg := range call.Args {
+		// Arguments are typed from their parameters, like assigned values.
+		if i < len(params) {
+			args = append(args, cg.emitValue(params[i].Type, arg))
+		} else {
+			args = append(args, cg.emitExpression(arg))
+		}
+	}
+	return fmt.Sprintf("%s(%s)", callee, strings.Join(args, ", "))
+}
+
+// findFunction returns the top-level function with the given name, or the
+// zero FunctionDecl if there is none, e.g. for a C library function.
+func (cg *CodeGenerator) findFunction(name string) FunctionDecl {
+	for _, decl := range cg.ast.Declarations {
+		if fn, ok := decl.(FunctionDecl); ok && fn.Name == name {
+			return fn
+		}
+	}
+	return FunctionDecl{}
+}
+
+// findMethod finds the named method of an object of the given class, and
+// the class defining it, searching up through the parents.
+func (cg *CodeGenerator) findMethod(class, method string) (ClassDecl, FunctionDecl, bool) {
+	for _, cls := range cg.ancestry(class) {
+		for _, mem := range cls.Members {
+			if fn, ok := mem.(FunctionDecl); ok && fn.Name == method {
+				return cls, fn, true
+			}
+		}
+	}
+	return ClassDecl{}, FunctionDecl{}, false
+}
+
+// encodeUnicodeEscapes rewrites the \u and \U escapes in a string or
+// character literal as the octal escapes of their UTF-8 bytes, which every C
+// compiler accepts regardless of its source and execution character sets.
+// Other escapes are left as they are.
+func encodeUnicodeEscapes(lit string) string {
+	if !strings.Contains(lit, `\u`) && !strings.Contains(lit, `\U`) {
+		return lit
+	}
+	var out strings.Builder
+	for i := 0; i < len(lit); i++ {
+		if lit[i] != '\\' {
+			out.WriteByte(lit[i])
+			continue
+		}
+		switch lit[i+1] {
+		case 'u', 'U':
+			n := 4
+			if lit[i+1] == 'U' {
+				n = 8
+			}
+			code, _ := strconv.ParseUint(lit[i+2:i+2+n], 16, 32)
+			var buf [utf8.UTFMax]byte
+			for _, b := range buf[:utf8.EncodeRune(buf[:], rune(code))] {
+				fmt.Fprintf(&out, "\\%03o", b)
+			}
+			i += 1 + n
+		default:
+			// Copy the backslash and the escaped character together so an
+			// escaped backslash is never mistaken for the start of \u.
+			out.WriteString(lit[i : i+2])
+			i++
+		}
+	}
+	return out.String()
+}
+
+// emitPrimary emits expr as the operand of a postfix operator such as . or
+// ++, parenthesizing it unless it already binds that tightly.
+func (cg *CodeGenerator) emitPrimary(expr Node) string {
+	code := cg.emitExpression(expr)
+	switch expr.(type) {
+	case BinaryExpr, UnaryExpr:
+		return "(" + code + ")"
+	}
+	return code
+}
+
+// fieldType returns the declared type of a field of the named class or its
+// ancestors, or "" if there is no such field.
+func (cg *CodeGenerator) fieldType(class, field string) string {
+	v, _ := cg.findField(class, field)
+	return v.VarType
+}
+
+// ancestry returns the named class followed by its parent, grandparent and
+// so on, or nothing if there is no such class. The parser rejects cyclic
+// inheritance, but the walk is bounded all the same.
+func (cg *CodeGenerator) ancestry(class string) []ClassDecl {
+	var chain []ClassDecl
+	for cls, ok := cg.classes[class]; ok && len(chain) <= len(cg.classes); cls, ok = cg.classes[cls.Parent] {
+		chain = append(chain, cls)
+	}
+	return chain
+}
+
+// fields returns the fields of the named class including inherited ones, in
+// struct layout order: those of the furthest ancestor first.
+func (cg *CodeGenerator) fields(class string) []VarDecl {
+	var fields []VarDecl
+	declared := make(map[string]string)
+	chain := cg.ancestry(class)
+	for i := len(chain) - 1; i >= 0; i-- {
+		for _, mem := range chain[i].Members {
+			v, ok := mem.(VarDecl)
+			if !ok {
+				continue
+			}
+			if owner, dup := declared[v.Name]; dup {
+				panic(fmt.Sprintf("field %s of class %s at line %d hides the field of %s", v.Name, chain[i].Name, v.Line, owner))
+			}
+			declared[v.Name] = chain[i].Name
+			fields = append(fields, v)
+		}
+	}
+	return fields
+}
+
+// findField looks up the declaration of a field of the named class or its
+// ancestors.
+func (cg *CodeGenerator) findField(class, field string) (VarDecl, bool) {
+	for _, cls := range cg.ancestry(class) {
+		for _, mem := range cls.Members {
+			if v, ok := mem.(VarDecl); ok && v.Name == field {
+				return v, true
+			}
+		}
+	}
+	return VarDecl{}, false
+}
+
+// checkWritable panics if target, the left of an assignment or the operand
+// of ++ or --, is a readonly field. Readonly fields are not emitted as const,
+// since the generated init function still has to set them.
+func (cg *CodeGenerator) checkWritable(target Node) {
+	m, ok := target.(MemberAccess)
+	if !ok {
+		return
+	}
+	class := strings.TrimSuffix(cg.exprType(m.Object), "*")
+	if v, ok := cg.findField(class, m.Member); ok && v.Readonly {
+		panic(fmt.Sprintf("cannot assign to readonly field %s.%s, declared at line %d", class, m.Member, v.Line))
+	}
+}
+
+// emitInterpolated lowers an interpolated string to a call to the
+// xs_format runtime helper, choosing each conversion from the type of the
+// embedded expression.
+func (cg *CodeGenerator) emitInterpolated(s InterpolatedString) string {
+	var format strings.Builder
+	var args []string
+	for i, expr := range s.Exprs {
+		format.WriteString(strings.ReplaceAll(s.Text[i], "%", "%%"))
+		typ := cg.exprType(expr)
+		spec, ok := formatSpecs[typ]
+		if !ok {
+			panic(fmt.Sprintf("cannot format {%s} in interpolated string: unknown type %q", cg.emitExpression(expr), typ))
+		}
+		format.WriteString(spec)
+		args = append(args, cg.emitExpression(expr))
+	}
+	format.WriteString(strings.ReplaceAll(s.Text[len(s.Exprs)], "%", "%%"))
+	if cg.std == "c89" {
+		panic("string interpolation needs vsnprintf, which C89 lacks; use --cstd=c99 or later")
+	}
+	cg.used["xs_format"] = true
+	args = append([]string{encodeUnicodeEscapes(`"` + format.String() + `"`)}, args...)
+	return fmt.Sprintf("xs_format(%s)", strings.Join(args, ", "))
+}
+
+// formatSpecs maps types to the printf conversion used to format them.
+var formatSpecs = map[string]string{
+	"bool": "%d", "byte": "%d", "short": "%d", "int": "%d",
+	"unsigned": "%u", "long": "%ld",
+	"float": "%g", "double": "%g",
+	"char": "%c", "string": "%s", "char*": "%s",
+}
+
+// exprType works out the type of an expression from its literals and the
+// declared types of the variables in scope. It returns "" when the type
+// cannot be determined.
+func (cg *CodeGenerator) exprType(expr Node) string {
+	switch e := expr.(type) {
+	case Expression:
+		switch {
+		case e.Value == "":
+			return ""
+		case e.Value[0] == '"':
+			return "string"
+		case e.Value == "true" || e.Value == "false":
+			return "bool"
+		case e.Value[0] >= '0' && e.Value[0] <= '9':
+			return numberType(e.Value)
+		}
+		if typ, ok := cg.vars[e.Value]; ok {
+			return typ
+		}
+		return cg.globals[e.Value]
+	case CharLiteral:
+		return "char"
+	case InterpolatedString:
+		return "string"
+	case UnaryExpr:
+		if e.Op == "!" {
+			return "bool"
+		}
+		return cg.exprType(e.Operand)
+	case PostfixExpr:
+		return cg.exprType(e.Operand)
+	case NewExpr:
+		return e.Class + "*"
+	case CallExpr:
+		switch callee := e.Callee.(type) {
+		case MemberAccess:
+			_, fn, _ := cg.findMethod(strings.TrimSuffix(cg.exprType(callee.Object), "*"), callee.Member)
+			return fn.RetType
+		case Expression:
+			return cg.funcs[callee.Value]
+		}
+		return ""
+	case MemberAccess:
+		return cg.fieldType(strings.TrimSuffix(cg.exprType(e.Object), "*"), e.Member)
+	case Index:
+		// Indexing a pointer yields the pointed-to type.
+		typ := cg.exprType(e.Object)
+		if typ == "string" {
+			return "char"
+		}
+		if strings.HasSuffix(typ, "*") {
+			return strings.TrimSuffix(typ, "*")
+		}
+		return ""
+	case BinaryExpr:
+		switch e.Op {
+		case "==", "!=", "<", ">", "<=", ">=", "&&", "||":
+			return "bool"
+		}
+		// Arithmetic takes the wider of its operand types.
+		left, right := cg.exprType(e.Left), cg.exprType(e.Right)
+		for _, wide := range []string{"double", "float", "long", "unsigned"} {
+			if left == wide || right == wide {
+				return wide
+			}
+		}
+		if left == "" || right == "" {
+			return ""
+		}
+		return "int"
+	}
+	return ""
+}
+
+// numberType returns the type of a numeric literal, from its form and suffix.
+func numberType(lit string) string {
+	suffix := strings.ToLower(lit[len(strings.TrimRight(lit, "fFuUlL")):])
+	switch {
+	case suffix == "f":
+		return "float"
+	case strings.ContainsAny(lit, ".eE"):
+		return "double"
+	case strings.Contains(suffix, "l"):
+		return "long"
+	case strings.Contains(suffix, "u"):
+		return "unsigned"
+	}
+	return "int"
+}
+
+// emitOperand emits an operand of the binary operator op, adding parentheses
+// when the operand binds more loosely than C would otherwise assume.
+func (cg *CodeGenerator) emitOperand(operand Node, op string, right bool) string {
+	code := cg.emitExpression(operand)
+	if b, ok := operand.(BinaryExpr); ok {
+		inner, outer := binaryPrecedence[b.Op], binaryPrecedence[op]
+		// Operators are left-associative, so a right operand at the same
+		// level also needs parentheses.
+		if inner < outer || (right && inner == outer) {
+			return "(" + code + ")"
+		}
+	}
+	return code
 }
 
 // emitClass generates C code for a class declaration.
 // It emits a C struct for the class and functions for its methods.
 func (cg *CodeGenerator) emitClass(cls ClassDecl) {
-	// Emit the struct definition for the class.
-	cg.code.WriteString(fmt.Sprintf("typedef struct %s {\n", cls.Name))
-	// For now, only handle member variable declarations.
+	defer cg.recordSpan(cls.Line, cg.code.Len())
+	cg.emitClassStruct(cls)
+	cg.emitClassMethods(cls)
+}
+
+// emitClassHeader generates a self-contained header for a class: its struct
+// and method prototypes, guarded against double inclusion and including the
+// shared header, which declares every class, and the headers of the classes
+// it needs complete.
+func (cg *CodeGenerator) emitClassHeader(cls ClassDecl, classes map[string]bool, shared string) {
+	guard := strings.ToUpper(cls.Name) + "_H"
+	cg.code.WriteString(fmt.Sprintf("#ifndef %s\n#define %s\n\n", guard, guard))
+	cg.code.WriteString(fmt.Sprintf("#include \"%s\"\n", shared))
+	for _, dep := range classDeps(cls, classes) {
+		cg.code.WriteString(fmt.Sprintf("#include \"%s.h\"\n", dep))
+	}
+	cg.code.WriteString("\n")
+	cg.emitClassStruct(cls)
+	methods := 0
+	if cg.needsInit(cls.Name) {
+		cg.code.WriteString(initSignature(cls) + ";\n")
+		methods++
+	}
+	for _, mem := range cls.Members {
+		if fn, ok := mem.(FunctionDecl); ok {
+			cg.code.WriteString(methodSignature(cls, fn) + ";\n")
+			methods++
+		}
+	}
+	if methods > 0 {
+		cg.code.WriteString("\n")
+	}
+	cg.code.WriteString(fmt.Sprintf("#endif /* %s */\n", guard))
+}
+
+// classDeps returns the other classes that cls uses by value through its
+// parent, fields, or method signatures, in sorted order. Classes it only
+// points to need no definition, their forward typedef being enough.
+func classDeps(cls ClassDecl, classes map[string]bool) []string {
+	seen := make(map[string]bool)
+	add := func(typ string) {
+		if classes[typ] && typ != cls.Name {
+			seen[typ] = true
+		}
+	}
+	add(cls.Parent)
 	for _, mem := range cls.Members {
-		if v, ok := mem.(VarDecl); ok {
-			cg.code.WriteString(fmt.Sprintf("    %s %s;\n", v.VarType, v.Name))
+		switch m := mem.(type) {
+		case VarDecl:
+			add(m.VarType)
+		case FunctionDecl:
+			add(m.RetType)
+			for _, param := range m.Params {
+				add(param.Type)
+			}
 		}
 	}
-	cg.code.WriteString(fmt.Sprintf("} %s;\n\n", cls.Name))
-	// Emit methods as functions, with the first parameter being a pointer to the class instance.
+	var deps []string
+	for dep := range seen {
+		deps = append(deps, dep)
+	}
+	sort.Strings(deps)
+	return deps
+}
+
+// methodSignature returns the C signature of a method, whose first
+// parameter is a pointer to the class instance.
+func methodSignature(cls ClassDecl, fn FunctionDecl) string {
+	params := []string{fmt.Sprintf("%s* this", cls.Name)}
+	for _, param := range fn.Params {
+		params = append(params, fmt.Sprintf("%s %s", param.Type, param.Name))
+	}
+	return fmt.Sprintf("%s %s_%s(%s)", fn.RetType, cls.Name, fn.Name, strings.Join(params, ", "))
+}
+
+// emitClassStruct emits the C struct definition for a class.
+func (cg *CodeGenerator) emitClassStruct(cls ClassDecl) {
+	defer cg.recordSize("class", cls.Name, cg.code.Len())
+	// Emit the struct definition for the class. Split output has already
+	// declared the typedef, which C99 does not allow to be repeated.
+	if cg.split {
+		cg.code.WriteString(fmt.Sprintf("struct %s {\n", cls.Name))
+	} else {
+		cg.code.WriteString(fmt.Sprintf("typedef struct %s {\n", cls.Name))
+	}
+	// Inherited fields come first, so that a pointer to the class can be
+	// passed to its ancestors' methods.
+	for _, v := range cg.fields(cls.Name) {
+		start := cg.code.Len()
+		cg.code.WriteString(fmt.Sprintf("    %s %s;\n", v.VarType, v.Name))
+		cg.recordSpan(v.Line, start)
+	}
+	if cg.split {
+		cg.code.WriteString("};\n\n")
+	} else {
+		cg.code.WriteString(fmt.Sprintf("} %s;\n\n", cls.Name))
+	}
+}
+
+// emitClassMethods emits a class's methods as functions, with the first
+// parameter being a pointer to the class instance.
+func (cg *CodeGenerator) emitClassMethods(cls ClassDecl) {
+	defer cg.recordSize("class", cls.Name, cg.code.Len())
+	if cg.needsInit(cls.Name) {
+		if _, _, clash := cg.findMethod(cls.Name, "init"); clash {
+			panic(fmt.Sprintf("method %s.init clashes with the function that applies its field defaults", cls.Name))
+		}
+		start := cg.code.Len()
+		cg.code.WriteString(linkage(cls.Private && !cg.split) + initSignature(cls) + " {\n")
+		cg.vars = map[string]string{"this": cls.Name + "*"}
+		// The parent's init applies the inherited defaults.
+		if cls.Parent != "" && cg.needsInit(cls.Parent) {
+			cg.code.WriteString(fmt.Sprintf("    %s_init((%s*)this);\n", cls.Parent, cls.Parent))
+		}
+		for _, mem := range cls.Members {
+			field, ok := mem.(VarDecl)
+			switch {
+			case !ok:
+			case field.Default != nil:
+				start := cg.code.Len()
+				cg.code.WriteString(fmt.Sprintf("    this->%s = %s;\n", field.Name, cg.emitValue(field.VarType, field.Default)))
+				cg.recordSpan(field.Line, start)
+			case cg.needsInit(field.VarType):
+				cg.code.WriteString(fmt.Sprintf("    %s_init(&this->%s);\n", field.VarType, field.Name))
+			}
+		}
+		cg.code.WriteString("    return this;\n}\n\n")
+		cg.recordSize("method", cls.Name+".init", start)
+	}
 	for _, mem := range cls.Members {
 		if fn, ok := mem.(FunctionDecl); ok {
-			params := []string{fmt.Sprintf("%s* this", cls.Name)}
-			for _, param := range fn.Params {
-				params = append(params, fmt.Sprintf("%s %s", param.Type, param.Name))
-			}
-			cg.code.WriteString(fmt.Sprintf("%s %s_%s(%s) {\n", fn.RetType, cls.Name, fn.Name, strings.Join(params, ", ")))
+			start := cg.code.Len()
+			// Methods of a private class are static, unless the class is in
+			// its own file and called from the others.
+			cg.code.WriteString(linkage(cls.Private && !cg.split) + methodSignature(cls, fn) + " {\n")
 			cg.indent = "    "
-			for _, stmt := range fn.Body {
-				cg.emitStatement(stmt)
+			cg.vars = map[string]string{"this": cls.Name + "*"}
+			cg.ret = fn.RetType
+			cg.resetStatics()
+			for _, param := range fn.Params {
+				cg.vars[param.Name] = param.Type
 			}
+			cg.emitBody(fn.Body)
 			cg.code.WriteString("}\n\n")
+			cg.recordSize("method", cls.Name+"."+fn.Name, start)
+			cg.recordSpan(fn.Line, start)
 		}
 	}
 }
@@ -414,50 +2915,271 @@ func (cg *CodeGenerator) emitClass(cls ClassDecl) {
    It reads the input source file and writes the generated C code to the output file.
 */
 
+// Exit codes returned by the command-line interface.
+const (
+	exitOK          = 0 // Success.
+	exitDiagnostics = 1 // Errors in the input (or reading/writing files) were reported.
+	exitUsage       = 2 // The command line was invalid.
+	exitInternal    = 3 // The compiler itself failed.
+)
+
 func main() {
-	// Ensure correct usage: compiler <input_file> <output_file>
-	if len(os.Args) != 3 {
-		fmt.Println("Usage: compiler <input_file> <output_file>")
-		os.Exit(1)
+	// Subcommands are dispatched before flag parsing; anything else is a
+	// plain compile of an input file to an output file.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "explain":
+			runExplain(os.Args[2:])
+			return
+		case "build":
+			runBuild(os.Args[2:])
+			return
+		case "run":
+			runRun(os.Args[2:])
+			return
+		case "lint":
+			runLint(os.Args[2:])
+			return
+		case "stats":
+			runStats(os.Args[2:])
+			return
+		case "grammar":
+			runGrammar(os.Args[2:])
+			return
+		case "index":
+			runIndex(os.Args[2:])
+			return
+		}
+	}
+
+	splitOutput := flag.Bool("split-output", false, "write a separate .c/.h pair per class next to the output file")
+	autoSemicolons := flag.Bool("auto-semicolons", false, "treat line ends as statement terminators where a statement can end")
+	quiet := flag.Bool("quiet", false, "do not print a message on success")
+	reportSize := flag.Bool("report-size", false, "print how much C code each class and function generated")
+	headerFile := flag.String("header", "", "put the text of this `file`, such as a license notice, in the comment at the top of generated files")
+	tabWidth := flag.Int("tab-width", defaultTabWidth, "columns between tab stops, for the column numbers in error messages")
+	cstd := flag.String("cstd", "c99", "C standard the generated code must build under: c89, c99 or c11")
+	showVersion := flag.Bool("version", false, "print the compiler version and exit")
+	compileCommands := flag.Bool("compile-commands", false, "write a compile_commands.json for the generated C next to the output file")
+	var rewriters rewriterFlag
+	flag.Var(&rewriters, "rewriter", "run `command` on the tokens as JSON before parsing; may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: compiler [flags] <input_file> <output_file>")
+		flag.PrintDefaults()
 	}
-	inputFile := os.Args[1]
-	outputFile := os.Args[2]
+	flag.Parse()
+	if *showVersion {
+		fmt.Println("xsharp " + versionString())
+		return
+	}
+	// Ensure correct usage: compiler [flags] <input_file> <output_file>
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	checkStandard(*cstd)
+	inputFile := flag.Arg(0)
+	outputFile := flag.Arg(1)
+	startStats("compile", []string{inputFile})
+	defer finishStats(exitOK)
 	// Read the entire source code from the input file.
 	data, err := ioutil.ReadFile(inputFile)
 	if err != nil {
-		fmt.Println("Error reading input file:", err)
-		os.Exit(1)
+		fail(fmt.Errorf("Error reading input file: %v", err))
 	}
 	code := string(data)
+	header := ""
+	if *headerFile != "" {
+		text, err := ioutil.ReadFile(*headerFile)
+		if err != nil {
+			fail(fmt.Errorf("Error reading header file: %v", err))
+		}
+		header = string(text)
+	}
+	banner := provenanceBanner(header, inputFile, data)
 
-	// --- Lexing ---
-	tokens, err := tokenize(code)
+	// --- Lexing and Parsing ---
+	ast, err := parseSource(code, inputFile, ParseOptions{AutoSemicolons: *autoSemicolons, TabWidth: *tabWidth, Rewriters: rewriters.rewriters()})
 	if err != nil {
-		fmt.Println("Lexing error:", err)
-		os.Exit(1)
+		fail(err)
 	}
 
-	// --- Parsing ---
-	parser := NewParser(tokens)
-	var ast Program
-	// Catch any panic during parsing and report an error.
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("Parsing error:", r)
-			os.Exit(1)
-		}
-	}()
-	ast = parser.parse()
-
 	// --- Code Generation ---
 	gen := NewCodeGenerator(ast)
-	cCode := gen.generate()
+	gen.std = *cstd
+	if *splitOutput {
+		// Write each generated file into the output file's directory.
+		dir := filepath.Dir(outputFile)
+		files, err := generateSplitC(gen, filepath.Base(outputFile))
+		if err != nil {
+			fail(err)
+		}
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var sources []string
+		for _, name := range names {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(banner+files[name]), 0644); err != nil {
+				fail(fmt.Errorf("Error writing output file: %v", err))
+			}
+			if strings.HasSuffix(name, ".c") {
+				sources = append(sources, name)
+			}
+		}
+		if *compileCommands {
+			if err := writeCompileCommands(dir, sources, CompileOptions{Std: *cstd}); err != nil {
+				fail(err)
+			}
+		}
+		if *reportSize {
+			printSizeReport(os.Stderr, gen.sizes)
+		}
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "C code generated and saved to %d files in %s\n", len(names), dir)
+		}
+		return
+	}
+	cCode, err := generateC(gen)
+	if err != nil {
+		fail(err)
+	}
 
 	// Write the generated C code to the output file.
-	err = ioutil.WriteFile(outputFile, []byte(cCode), 0644)
+	err = ioutil.WriteFile(outputFile, []byte(banner+cCode), 0644)
+	if err != nil {
+		fail(fmt.Errorf("Error writing output file: %v", err))
+	}
+	if *compileCommands {
+		if err := writeCompileCommands(filepath.Dir(outputFile), []string{filepath.Base(outputFile)}, CompileOptions{Std: *cstd}); err != nil {
+			fail(err)
+		}
+	}
+	if *reportSize {
+		printSizeReport(os.Stderr, gen.sizes)
+	}
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, "C code generated and saved to %s\n", outputFile)
+	}
+}
+
+// printSizeReport writes a table of generated code sizes, largest first.
+// Each class includes its methods, which are listed beneath it.
+func printSizeReport(w io.Writer, sizes []SizeEntry) {
+	var top []SizeEntry
+	methods := make(map[string][]SizeEntry)
+	totalLines, totalBytes := 0, 0
+	for _, e := range sizes {
+		if e.Kind == "method" {
+			class := e.Name[:strings.Index(e.Name, ".")]
+			methods[class] = append(methods[class], e)
+			continue
+		}
+		top = append(top, e)
+		totalLines += e.Lines
+		totalBytes += e.Bytes
+	}
+	largestFirst := func(entries []SizeEntry) {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Bytes > entries[j].Bytes })
+	}
+	largestFirst(top)
+	fmt.Fprintln(w, "Generated code size:")
+	for _, e := range top {
+		fmt.Fprintf(w, "  %-8s %-24s %6d lines %8d bytes\n", e.Kind, e.Name, e.Lines, e.Bytes)
+		largestFirst(methods[e.Name])
+		for _, m := range methods[e.Name] {
+			fmt.Fprintf(w, "    %-6s %-24s %6d lines %8d bytes\n", m.Kind, m.Name, m.Lines, m.Bytes)
+		}
+	}
+	fmt.Fprintf(w, "  %-33s %6d lines %8d bytes\n", "total", totalLines, totalBytes)
+}
+
+// internalError reports a failure of the compiler itself, as opposed to a
+// problem with the program being compiled.
+type internalError struct {
+	cause interface{} // The value the compiler panicked with.
+}
+
+func (e internalError) Error() string {
+	return fmt.Sprintf("Internal compiler error: %v", e.cause)
+}
+
+// fail prints err to stderr and exits with the matching exit code.
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	code := exitDiagnostics
+	var internal internalError
+	if errors.As(err, &internal) {
+		code = exitInternal
+	}
+	finishStats(code)
+	os.Exit(code)
+}
+
+// ParseOptions holds settings that change how source text is read.
+type ParseOptions struct {
+	AutoSemicolons bool            // Infer semicolons at line ends (see insertSemicolons).
+	TabWidth       int             // Tab width for columns in diagnostics (see LexOptions).
+	Rewriters      []TokenRewriter // Run in order after the built-in rewriting.
+}
+
+// TokenRewriter transforms the token stream between lexing and parsing, for
+// preprocessing such as semicolon inference. The --rewriter flag runs an
+// external program as one (see commandRewriter). The stream it gets and returns
+// ends with the EOF token. Inserted tokens should copy the Line and Column
+// of a nearby token, since diagnostics point at them. A rewriter reports an
+// error by panicking with a message, which becomes a parsing error.
+type TokenRewriter func(tokens []Token) []Token
+
+// parseSource lexes and parses code read from file. The parser reports
+// problems by panicking, so those panics are recovered and returned as errors.
+func parseSource(code, file string, opts ParseOptions) (ast Program, err error) {
+	tokens, err := tokenize(code, LexOptions{TabWidth: opts.TabWidth})
 	if err != nil {
-		fmt.Println("Error writing output file:", err)
-		os.Exit(1)
+		// Report every lexical error, one per line.
+		var msgs []string
+		for _, e := range err.(LexErrors) {
+			msgs = append(msgs, "Lexing error: "+e.Error())
+		}
+		return Program{}, errors.New(strings.Join(msgs, "\n"))
+	}
+	var rewriters []TokenRewriter
+	if opts.AutoSemicolons {
+		rewriters = append(rewriters, insertSemicolons)
+	}
+	defer recoverDiagnostic("Parsing", &err)
+	for _, rewrite := range append(rewriters, opts.Rewriters...) {
+		tokens = rewrite(tokens)
+	}
+	return NewParser(tokens, file).parse(), nil
+}
+
+// generateC runs the code generator, returning any panic raised for an
+// unsupported construct as an error.
+func generateC(gen *CodeGenerator) (code string, err error) {
+	defer recoverDiagnostic("Code generation", &err)
+	return gen.generate(), nil
+}
+
+// generateSplitC is like generateC, but generates a file per class.
+func generateSplitC(gen *CodeGenerator, mainFile string) (files map[string]string, err error) {
+	defer recoverDiagnostic("Code generation", &err)
+	return gen.generateSplit(mainFile), nil
+}
+
+// recoverDiagnostic, when deferred, turns a panic raised during the given
+// stage into an error stored in *err. The parser and code generator panic
+// with messages about the input; Go runtime errors mean a compiler bug and
+// become internal errors.
+func recoverDiagnostic(stage string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if _, ok := r.(runtime.Error); ok {
+		*err = internalError{cause: r}
+		return
 	}
-	fmt.Printf("C code generated and saved to %s\n", outputFile)
+	*err = fmt.Errorf("%s error: %v", stage, r)
 }
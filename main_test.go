@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// switchSource returns a program whose switch has the given case labels.
+func switchSource(labels ...string) string {
+	var b strings.Builder
+	b.WriteString("int main() {\n    int x = 1;\n    switch (x) {\n")
+	for _, label := range labels {
+		fmt.Fprintf(&b, "    case %s:\n        x = 2;\n", label)
+	}
+	b.WriteString("    }\n    return x;\n}\n")
+	return b.String()
+}
+
+func TestDuplicateCases(t *testing.T) {
+	tests := []struct {
+		labels []string
+		want   string // Expected error, or "" if the switch is valid.
+	}{
+		{[]string{"1", "2"}, ""},
+		{[]string{"'a'", "'b'"}, ""},
+		{[]string{"-1", "1"}, ""},
+		{[]string{"1", "1"}, "Duplicate case 1 at line 6; the first is at line 4"},
+		{[]string{"65", "0101"}, "Duplicate case 65 at line 6; the first is at line 4"},
+		{[]string{"'A'", "65"}, "Duplicate case 65 at line 6; the first is at line 4"},
+		{[]string{`'\0'`, "0"}, "Duplicate case 0 at line 6; the first is at line 4"},
+		{[]string{`'\101'`, "'A'"}, "Duplicate case 65 at line 6; the first is at line 4"},
+		{[]string{`'\x41'`, "65"}, "Duplicate case 65 at line 6; the first is at line 4"},
+		{[]string{`'\?'`, "63"}, "Duplicate case 63 at line 6; the first is at line 4"},
+		{[]string{`'\n'`, "10"}, "Duplicate case 10 at line 6; the first is at line 4"},
+		{[]string{"-0", "0"}, "Duplicate case 0 at line 6; the first is at line 4"},
+		{[]string{"1u", "2", "1"}, "Duplicate case 1 at line 8; the first is at line 4"},
+		{[]string{"x", "x"}, "Duplicate case x at line 6; the first is at line 4"},
+	}
+	for _, tt := range tests {
+		_, err := parseSource(switchSource(tt.labels...), "test.xs", ParseOptions{})
+		got := ""
+		if err != nil {
+			got = strings.TrimPrefix(err.Error(), "Parsing error: ")
+		}
+		if got != tt.want {
+			t.Errorf("cases %v: got error %q, want %q", tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestCRLFLineEnds(t *testing.T) {
+	source := "// A comment.\nint main() {\n    string s = `a\nb`;\n    return 0;\n}\n"
+	want, err := tokenize(source, LexOptions{})
+	if err != nil {
+		t.Fatalf("tokenize with LF: %v", err)
+	}
+	got, err := tokenize(strings.ReplaceAll(source, "\n", "\r\n"), LexOptions{})
+	if err != nil {
+		t.Fatalf("tokenize with CRLF: %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("CRLF tokens differ:\ngot  %v\nwant %v", got, want)
+	}
+}
+
+// runProgram compiles source to C for the C standard std, as one file or
+// split into a file per class, builds that with the local C compiler and
+// runs it, returning its exit status.
+func runProgram(t *testing.T, source, std string, split bool) int {
+	t.Helper()
+	tc, err := findToolchain()
+	if err != nil {
+		t.Skip(err)
+	}
+	ast, err := parseSource(source, "test.xs", ParseOptions{})
+	if err != nil {
+		t.Fatalf("parseSource: %v", err)
+	}
+	gen := NewCodeGenerator(ast)
+	gen.std = std
+	files := make(map[string]string)
+	if split {
+		files, err = generateSplitC(gen, "main.c")
+	} else {
+		files["main.c"], err = generateC(gen)
+	}
+	if err != nil {
+		t.Fatalf("code generation: %v", err)
+	}
+	dir := t.TempDir()
+	var sources []string
+	for name, code := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(name, ".c") {
+			sources = append(sources, name)
+		}
+	}
+	opts := CompileOptions{Std: std}
+	exe := filepath.Join(dir, "prog"+exeSuffix())
+	objects, err := tc.Compile(dir, sources, opts)
+	if err == nil {
+		err = tc.Link(dir, objects, exe, opts)
+	}
+	if err != nil {
+		t.Fatalf("%v; the generated C was:\n%s", err, files["main.c"])
+	}
+	err = exec.Command(exe).Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0
+}
+
+func TestGeneratedPrograms(t *testing.T) {
+	all, c99 := []string{"c89", "c99", "c11"}, []string{"c99", "c11"}
+	tests := []struct {
+		name   string
+		stds   []string // C standards to build for; object literals need C99.
+		source string
+		want   int // Exit status.
+	}{
+		{"field defaults", c99, `
+class P {
+    int a = 1;
+}
+class Q : P {
+    int c;
+}
+class R {
+    Q q;
+    int z = 9;
+}
+R gr;
+P gp;
+int main() {
+    Q q;
+    R r = { z: 1 };
+    Q* h = new Q();
+    int sum = gp.a + gr.q.a + q.a + r.q.a + h.a + gr.z;
+    delete h;
+    return sum;
+}
+`, 14},
+		{"object literals", c99, `
+class Point {
+    int x = 3;
+    int y;
+}
+int main() {
+    Point p = { y: 2 };
+    Point q = p;
+    q = { x: 4, y: 5 };
+    return p.x * 10 + p.y + q.x + q.y;
+}
+`, 41},
+		{"inherited members", all, `
+class A {
+    int v = 2;
+    int get() {
+        return this.v;
+    }
+}
+class B : A {
+    int w = 5;
+}
+int main() {
+    B b;
+    return b.get() + b.w;
+}
+`, 7},
+		{"declaration after use of an outer name", all, `
+int x = 5;
+int main() {
+    int y = 0;
+    y = x;
+    int x = 2;
+    return y + x;
+}
+`, 7},
+		{"switch", all, `
+int classify(int n) {
+    int r = 0;
+    switch (n) {
+    case 1:
+        r += 1;
+        fallthrough;
+    case 2:
+        r += 10;
+    default:
+        r += 100;
+    }
+    return r;
+}
+int main() {
+    return classify(1) + classify(3);
+}
+`, 111},
+		{"strings", all, `
+string greeting = "hello";
+int main() {
+    string path = p"C:\dir";
+    return strlen(greeting) + strlen(path);
+}
+`, 11},
+		{"split output", all, `
+class A {
+    B* other;
+    int v = 2;
+    int get() {
+        return twice(this.v) + counter;
+    }
+}
+class B {
+    A* back;
+    int w;
+}
+class C : A {
+    B b;
+}
+private int counter = 1;
+private int twice(int x) {
+    return x * 2;
+}
+int main() {
+    C c;
+    return c.get();
+}
+`, 5},
+	}
+	for _, tt := range tests {
+		for _, std := range tt.stds {
+			for _, split := range []bool{false, true} {
+				// Splitting only changes programs with classes.
+				if split && !strings.Contains(tt.source, "\nclass ") || !split && tt.name == "split output" {
+					continue
+				}
+				name := fmt.Sprintf("%s/%s/split=%v", tt.name, std, split)
+				t.Run(name, func(t *testing.T) {
+					if got := runProgram(t, tt.source, std, split); got != tt.want {
+						t.Errorf("exit status %d, want %d", got, tt.want)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestInterpolation(t *testing.T) {
+	source := `
+int main() {
+    int a = 12;
+    double b = 0.5;
+    string m = $"{a}-{b}";
+    int n = strlen(m);
+    delete m;
+    return n;
+}
+`
+	// vsnprintf, which xs_format needs, is C99.
+	for _, std := range []string{"c99", "c11"} {
+		if got := runProgram(t, source, std, false); got != 6 {
+			t.Errorf("%s: exit status %d, want 6", std, got)
+		}
+	}
+}
+
+// generate returns the C that source compiles to for C99.
+func generate(t *testing.T, source string) string {
+	t.Helper()
+	ast, err := parseSource(source, "test.xs", ParseOptions{})
+	if err != nil {
+		t.Fatalf("parseSource: %v", err)
+	}
+	code, err := generateC(NewCodeGenerator(ast))
+	if err != nil {
+		t.Fatalf("generateC: %v", err)
+	}
+	return code
+}
+
+func TestGeneratedC(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string // Lines the C must contain.
+	}{
+		{"arguments typed from parameters", `
+class V {
+    double scale(float k) {
+        return k;
+    }
+}
+double half(double d) {
+    return d / 2;
+}
+int main() {
+    V v;
+    return half(3) + v.scale(2);
+}
+`, []string{"    return half(3.0) + V_scale(&v, 2.0f);"}},
+		{"designated initializers", `
+class P {
+    int x;
+    int y = 7;
+}
+int main() {
+    P p = { x: 1 };
+    return p.y;
+}
+`, []string{"    P p = { .x = 1, .y = 7 };", "    this->y = 7;"}},
+		{"string type", `
+string s = "a";
+int main() {
+    return 0;
+}
+`, []string{"typedef char* string;", `string s = "a";`}},
+	}
+	for _, tt := range tests {
+		code := generate(t, tt.source)
+		for _, line := range tt.want {
+			if !strings.Contains(code, line+"\n") {
+				t.Errorf("%s: generated C lacks %q:\n%s", tt.name, line, code)
+			}
+		}
+	}
+}
+
+func TestHoistingForC89(t *testing.T) {
+	ast, err := parseSource("int main() {\n    int a = 1;\n    a += 1;\n    int b = a;\n    return b;\n}\n", "test.xs", ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := NewCodeGenerator(ast)
+	gen.std = "c89"
+	code, err := generateC(gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "int main() {\n    int a = 1;\n    int b;\n    a += 1;\n    b = a;\n    return b;\n}\n"
+	if !strings.Contains(code, want) {
+		t.Errorf("got\n%s\nwant it to contain\n%s", code, want)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string // Expected error.
+	}{
+		{"int main() {\n    delete \"abc\";\n    return 0;\n}\n",
+			"Code generation error: cannot delete a string literal, which is not on the heap, at line 2"},
+		{"int main() {\n    string s = \"abc\";\n    delete s;\n    return 0;\n}\n",
+			"Code generation error: cannot delete a string literal, which is not on the heap, at line 3"},
+		{"int main() {\n    int n = 1;\n    delete n;\n    return 0;\n}\n",
+			"Code generation error: cannot delete a value of type int, which is not a pointer, at line 3"},
+		{"class P {\n    readonly int x = 1;\n}\nint main() {\n    P p;\n    p.x = 2;\n    return 0;\n}\n",
+			"Code generation error: cannot assign to readonly field P.x, declared at line 2"},
+		{"class A : B {\n}\nclass B : A {\n}\n", "Parsing error: class A inherits from itself at line 1"},
+		{"int main() {\n    char c = 'é';\n    return 0;\n}\n", "Lexing error: character literal 'é' does not fit in a char; use a string at line 2, col 13"},
+		{"int main() {\n    return 0\n}\n", "Parsing error: Expected [SEMICOLON] but got RBRACE (}) at line 3"},
+	}
+	for _, tt := range tests {
+		ast, err := parseSource(tt.source, "test.xs", ParseOptions{})
+		if err == nil {
+			_, err = generateC(NewCodeGenerator(ast))
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got error %v, want %q", tt.source, err, tt.want)
+		}
+	}
+}
+
+func TestAutoSemicolons(t *testing.T) {
+	source := "[immutable]\nclass Point {\n    int x\n    int y\n}\nint main() {\n    Point p = { x: 1, y: 2 }\n    return p.y\n}\n"
+	ast, err := parseSource(source, "test.xs", ParseOptions{AutoSemicolons: true})
+	if err != nil {
+		t.Fatalf("parseSource: %v", err)
+	}
+	if cls := ast.Declarations[0].(ClassDecl); cls.Name != "Point" {
+		t.Errorf("first declaration is %s, want class Point", cls.Name)
+	}
+}
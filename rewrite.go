@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+/*
+   EXTERNAL TOKEN REWRITERS
+   ------------------------
+   `--rewriter command` runs a program as a TokenRewriter, so preprocessing
+   tools can be written in any language without building on the compiler's
+   source. The program reads the token stream as a JSON array of tokens on
+   its standard input and writes the rewritten stream, in the same form, to
+   its standard output, e.g.
+
+       [{"type": "ID", "value": "x", "line": 1, "column": 1}, ...]
+
+   Anything it writes to standard error is passed on, and a nonzero exit
+   status fails the compile.
+*/
+
+// rewriterFlag collects the commands of repeated --rewriter flags, which
+// run in the order given.
+type rewriterFlag []string
+
+func (f *rewriterFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *rewriterFlag) Set(command string) error {
+	if len(strings.Fields(command)) == 0 {
+		return fmt.Errorf("empty rewriter command")
+	}
+	*f = append(*f, command)
+	return nil
+}
+
+// rewriters returns a TokenRewriter for each command.
+func (f rewriterFlag) rewriters() []TokenRewriter {
+	var out []TokenRewriter
+	for _, command := range f {
+		out = append(out, commandRewriter(command))
+	}
+	return out
+}
+
+// commandRewriter returns a TokenRewriter that runs command, which like CC
+// may include arguments, on the token stream.
+func commandRewriter(command string) TokenRewriter {
+	return func(tokens []Token) []Token {
+		input, err := json.Marshal(tokens)
+		if err != nil {
+			panic(fmt.Sprintf("rewriter %s: %v", command, err))
+		}
+		args := strings.Fields(command)
+		var output bytes.Buffer
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(input), &output, os.Stderr
+		if err := cmd.Run(); err != nil {
+			panic(fmt.Sprintf("rewriter %s failed: %v", command, err))
+		}
+		var rewritten []Token
+		if err := json.Unmarshal(output.Bytes(), &rewritten); err != nil {
+			panic(fmt.Sprintf("rewriter %s wrote invalid tokens: %v", command, err))
+		}
+		if n := len(rewritten); n == 0 || rewritten[n-1].Type != "EOF" {
+			panic(fmt.Sprintf("rewriter %s dropped the EOF token", command))
+		}
+		return rewritten
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestParseSourceRunsRewriters(t *testing.T) {
+	var seen []Token
+	rename := func(tokens []Token) []Token {
+		seen = tokens
+		for i, tok := range tokens {
+			if tok.Type == "ID" && tok.Value == "entry" {
+				tokens[i].Value = "main"
+			}
+		}
+		return tokens
+	}
+	opts := ParseOptions{AutoSemicolons: true, Rewriters: []TokenRewriter{rename}}
+	ast, err := parseSource("int entry() {\n    return 0\n}\n", "test.xs", opts)
+	if err != nil {
+		t.Fatalf("parseSource: %v", err)
+	}
+	if fn := ast.Declarations[0].(FunctionDecl); fn.Name != "main" {
+		t.Errorf("function named %s, want main", fn.Name)
+	}
+	// Rewriters run after the built-in semicolon inference.
+	semicolons := 0
+	for _, tok := range seen {
+		if tok.Type == "SEMICOLON" {
+			semicolons++
+		}
+	}
+	if semicolons != 1 {
+		t.Errorf("rewriter saw %d semicolons, want the 1 inferred", semicolons)
+	}
+}
+
+func TestParseSourceReportsRewriterPanics(t *testing.T) {
+	reject := func(tokens []Token) []Token {
+		panic("no tokens allowed")
+	}
+	_, err := parseSource("int x;", "test.xs", ParseOptions{Rewriters: []TokenRewriter{reject}})
+	if err == nil || err.Error() != "Parsing error: no tokens allowed" {
+		t.Errorf("got error %v, want the rewriter's message as a parsing error", err)
+	}
+}
+
+func TestCommandRewriter(t *testing.T) {
+	if _, err := exec.LookPath("sed"); err != nil {
+		t.Skip("needs sed")
+	}
+	source := "int entry() {\n    return 0;\n}\n"
+	rewriters := []TokenRewriter{commandRewriter(`sed s/"entry"/"main"/`)}
+	ast, err := parseSource(source, "test.xs", ParseOptions{Rewriters: rewriters})
+	if err != nil {
+		t.Fatalf("parseSource: %v", err)
+	}
+	fn := ast.Declarations[0].(FunctionDecl)
+	if fn.Name != "main" || fn.Line != 1 {
+		t.Errorf("got function %s at line %d, want main at line 1", fn.Name, fn.Line)
+	}
+
+	rewriters = []TokenRewriter{commandRewriter("sed s/EOF/ID/")}
+	_, err = parseSource(source, "test.xs", ParseOptions{Rewriters: rewriters})
+	if err == nil || !strings.Contains(err.Error(), "dropped the EOF token") {
+		t.Errorf("got error %v, want one about the missing EOF token", err)
+	}
+}
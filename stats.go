@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+   COMPILE STATISTICS
+   ------------------
+   With XSHARP_STATS=1 in the environment, every compile, build and run
+   appends a line to ~/.xsharp/stats.jsonl saying how long it took, how big
+   the input was and how it ended. Nothing leaves the machine. `xsharp stats`
+   summarizes the history, so build-time regressions show up as trends.
+*/
+
+// statsWindow is how many recent compiles `xsharp stats` compares with the
+// ones before them.
+const statsWindow = 10
+
+// compileRecord is one line of the statistics file.
+type compileRecord struct {
+	Time    time.Time `json:"time"`    // When the compile started.
+	Command string    `json:"command"` // "compile", "build" or "run".
+	Files   int       `json:"files"`   // Number of input files.
+	Lines   int       `json:"lines"`   // Total lines of input.
+	Millis  int64     `json:"millis"`  // Duration of the compile.
+	Exit    int       `json:"exit"`    // Exit code, one of the exit* constants.
+}
+
+// currentCompile is the compile being timed, or nil if statistics are off
+// or it has already been recorded.
+var currentCompile *compileRecord
+
+// statsFile returns the path of the statistics file.
+func statsFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".xsharp", "stats.jsonl"), nil
+}
+
+// startStats begins timing a compile of inputFiles, if statistics are on.
+func startStats(command string, inputFiles []string) {
+	if os.Getenv("XSHARP_STATS") != "1" {
+		return
+	}
+	rec := &compileRecord{Time: time.Now(), Command: command, Files: len(inputFiles)}
+	for _, file := range inputFiles {
+		if data, err := ioutil.ReadFile(file); err == nil {
+			rec.Lines += strings.Count(string(data), "\n")
+		}
+	}
+	currentCompile = rec
+}
+
+// finishStats records the compile being timed as having ended with the exit
+// code exit. Statistics are a convenience, so failing to write them is not
+// an error.
+func finishStats(exit int) {
+	rec := currentCompile
+	if rec == nil {
+		return
+	}
+	currentCompile = nil
+	rec.Millis = time.Since(rec.Time).Milliseconds()
+	rec.Exit = exit
+	path, err := statsFile()
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	line, _ := json.Marshal(rec)
+	f.Write(append(line, '\n'))
+}
+
+// runStats implements the stats subcommand.
+func runStats(args []string) {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: compiler stats")
+		os.Exit(exitUsage)
+	}
+	path, err := statsFile()
+	if err != nil {
+		fail(err)
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		fmt.Println("No compiles recorded. Set XSHARP_STATS=1 to start recording them.")
+		return
+	}
+	if err != nil {
+		fail(err)
+	}
+	defer f.Close()
+	var records []compileRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec compileRecord
+		// Skip lines cut short by a crash rather than giving up.
+		if json.Unmarshal(scanner.Bytes(), &rec) == nil {
+			records = append(records, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fail(fmt.Errorf("Error reading %s: %v", path, err))
+	}
+	if len(records) == 0 {
+		fmt.Println("No compiles recorded.")
+		return
+	}
+	printStats(os.Stdout, records)
+}
+
+// printStats writes the summary of the statistics to w.
+func printStats(w io.Writer, records []compileRecord) {
+	first, last := records[0], records[len(records)-1]
+	fmt.Fprintf(w, "%s since %s\n", plural(len(records), "compile"), first.Time.Format("2006-01-02"))
+
+	exits := make(map[int]int)
+	for _, rec := range records {
+		exits[rec.Exit]++
+	}
+	var codes []int
+	for code := range exits {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  exit %d (%s): %d\n", code, exitMeaning(code), exits[code])
+	}
+
+	recent := records[max(0, len(records)-statsWindow):]
+	earlier := records[max(0, len(records)-2*statsWindow) : len(records)-len(recent)]
+	fmt.Fprintf(w, "Average time of the last %s: %dms", plural(len(recent), "compile"), averageMillis(recent))
+	if len(earlier) > 0 {
+		before := averageMillis(earlier)
+		fmt.Fprintf(w, ", %dms for the %d before", before, len(earlier))
+		if before > 0 {
+			fmt.Fprintf(w, " (%+d%%)", (averageMillis(recent)-before)*100/before)
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Latest input: %s in %s, largest: %s\n", plural(last.Lines, "line"), plural(last.Files, "file"), plural(maxLines(records), "line"))
+}
+
+// exitMeaning describes an exit code.
+func exitMeaning(code int) string {
+	switch code {
+	case exitOK:
+		return "success"
+	case exitDiagnostics:
+		return "errors in the input"
+	case exitUsage:
+		return "invalid command line"
+	case exitInternal:
+		return "compiler failure"
+	}
+	return "unknown"
+}
+
+// averageMillis returns the mean duration of records.
+func averageMillis(records []compileRecord) int64 {
+	var total int64
+	for _, rec := range records {
+		total += rec.Millis
+	}
+	return total / int64(len(records))
+}
+
+// maxLines returns the largest input size among records.
+func maxLines(records []compileRecord) int {
+	most := 0
+	for _, rec := range records {
+		most = max(most, rec.Lines)
+	}
+	return most
+}
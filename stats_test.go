@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintStats(t *testing.T) {
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	var records []compileRecord
+	for i := 0; i < 12; i++ {
+		rec := compileRecord{Time: start.Add(time.Duration(i) * time.Minute), Command: "compile", Files: 1, Lines: 10 + i, Millis: 100}
+		if i >= 2 {
+			rec.Millis = 50 // The last ten compiles got faster.
+		}
+		if i == 3 {
+			rec.Exit = exitDiagnostics
+		}
+		records = append(records, rec)
+	}
+	var out strings.Builder
+	printStats(&out, records)
+	want := `12 compiles since 2026-01-02
+  exit 0 (success): 11
+  exit 1 (errors in the input): 1
+Average time of the last 10 compiles: 50ms, 100ms for the 2 before (-50%)
+Latest input: 21 lines in 1 file, largest: 21 lines
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
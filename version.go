@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+/*
+   VERSION AND PROVENANCE
+   ----------------------
+   Every generated file starts with a comment saying which compiler produced
+   it, from which source and with which options, so generated C found later
+   can be traced back and regenerated.
+*/
+
+// version is the compiler release. Release builds set it with
+// -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// versionString returns the version followed by the commit the compiler was
+// built from, when the Go toolchain recorded one.
+func versionString() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version
+	}
+	commit, modified := "", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			commit = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if commit == "" {
+		return version
+	}
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	if modified {
+		commit += "-dirty"
+	}
+	return fmt.Sprintf("%s (commit %s)", version, commit)
+}
+
+// provenanceBanner returns the comment placed at the top of generated files.
+// header, if not empty, is extra text such as a license notice, which goes
+// first.
+func provenanceBanner(header, inputFile string, source []byte) string {
+	var lines []string
+	if header != "" {
+		lines = append(lines, strings.Split(strings.TrimRight(header, "\n"), "\n")...)
+		lines = append(lines, "")
+	}
+	lines = append(lines,
+		"Generated by xsharp "+versionString()+". Do not edit.",
+		fmt.Sprintf("Source: %s (sha256 %x)", inputFile, sha256.Sum256(source)),
+	)
+	var opts []string
+	flag.Visit(func(f *flag.Flag) {
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() && f.Value.String() == "true" {
+			opts = append(opts, "--"+f.Name)
+			return
+		}
+		opts = append(opts, fmt.Sprintf("--%s=%s", f.Name, f.Value))
+	})
+	if len(opts) > 0 {
+		lines = append(lines, "Options: "+strings.Join(opts, " "))
+	}
+
+	var out strings.Builder
+	out.WriteString("/*\n")
+	for _, line := range lines {
+		// The text must not end the comment early.
+		line = strings.ReplaceAll(line, "*/", "* /")
+		out.WriteString(strings.TrimRight(" * "+line, " ") + "\n")
+	}
+	out.WriteString(" */\n\n")
+	return out.String()
+}